@@ -0,0 +1,578 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	awsSqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/urfave/cli/v2"
+
+	"github.com/lucaslobo/aggregator/internal/common/closer"
+	"github.com/lucaslobo/aggregator/internal/common/logs"
+	"github.com/lucaslobo/aggregator/internal/common/sqs"
+	"github.com/lucaslobo/aggregator/internal/core/application"
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+	"github.com/lucaslobo/aggregator/internal/core/inboundprt"
+	"github.com/lucaslobo/aggregator/internal/core/outboundprt"
+	"github.com/lucaslobo/aggregator/internal/inbound"
+	"github.com/lucaslobo/aggregator/internal/outbound"
+)
+
+const (
+	// prop names are used to identify values for the CLI commands
+	windowSizeFlagPropName   = "window_size"
+	windowFlagPropName       = "window"
+	bucketFlagPropName       = "bucket"
+	inputFileFlagPropName    = "input_file"
+	outputFolderFlagPropName = "output_folder"
+	inputQueueFlagPropName   = "queue_url"
+	groupByFlagPropName      = "group_by"
+	latenessFlagPropName     = "allowed_lateness"
+	gracePeriodFlagPropName  = "grace_period"
+	skipEmptyFlagPropName    = "skip_empty"
+	windowTypeFlagPropName   = "window_type"
+	hopFlagPropName          = "hop"
+	sessionGapFlagPropName   = "session_gap"
+	stateFileFlagPropName    = "state_file"
+	checkpointFlagPropName   = "checkpoint_interval"
+	resumeFlagPropName       = "resume"
+	dedupWindowFlagPropName  = "dedup_window"
+	filterFlagPropName       = "filter"
+	pollersFlagPropName      = "pollers"
+	workersFlagPropName      = "workers"
+	drainFlagPropName        = "drain"
+	untilFlagPropName        = "until"
+	inputOrderFlagPropName   = "input_order"
+	mergeFlagPropName        = "merge"
+)
+
+// asyncBufferSize is the number of writes buffered when the output is written by a separate goroutine
+const asyncBufferSize = 1024
+
+// cancelledExitCode is the exit status when the processing is stopped by a signal, like shells report for a Ctrl-C
+const cancelledExitCode = 130
+
+// storer is implemented by all the outbound adapters that can store the results of the commands
+type storer interface {
+	outboundprt.MovingAverageStorer
+	outboundprt.PercentileStorer
+	outboundprt.RejectedEventStorer
+}
+
+type cmdCfg struct {
+	logger logs.Logger
+
+	windowType string
+	// windows holds the sizes of the windows aggregated at once. There is more than one only for sliding or hopping
+	// windows.
+	windows         []time.Duration
+	bucket          time.Duration
+	windowSizes     []int
+	hop             time.Duration
+	sessionGap      time.Duration
+	groupBy         []string
+	allowedLateness time.Duration
+	gracePeriod     time.Duration
+	skipEmpty       bool
+	queueURL        string
+	// inputFiles holds the input files, in the order they're processed
+	inputFiles []string
+	// merge makes the input files be merged by the timestamps of their events, instead of processed one after the other
+	merge        bool
+	outputFolder string
+	// checkpointInterval is only used when there is a stateStorer
+	checkpointInterval time.Duration
+	// resume makes the file processing continue from the last checkpoint
+	resume bool
+	// inputMode is one of the inbound input modes, which identifies what the offsets of the checkpoints count
+	inputMode string
+	// dedupWindow is how long translation ids are kept to drop duplicate events. If 0, events are not deduplicated.
+	dedupWindow time.Duration
+	// filter is an expression that events must match to be processed. If empty, all events are processed.
+	filter string
+	// pollers is the number of goroutines polling the queue concurrently
+	pollers int
+	// workers is the number of goroutines decoding the input file. If more than 1, the file is processed in a pipeline.
+	workers int
+	// drain makes the windows advance at the end of the input file until they're empty
+	drain bool
+	// until makes the windows advance at the end of the input file until this time, if it's not zero
+	until time.Time
+
+	storer      storer
+	stateStorer outboundprt.StateStorer
+	svc         inboundprt.EventRouter
+}
+
+// commonFlags returns the flags shared by all the commands
+func commonFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.DurationFlag{Name: bucketFlagPropName, Required: false, Value: time.Minute, Usage: "Duration of each time-bucket (e.g., 10s, 1m, 5m, 1h). One output line is written per time-bucket"},
+		&cli.StringSliceFlag{Name: inputFileFlagPropName, Required: false, Usage: "File (.json) that contains input events, or - to read them from the stdin. Files compressed with gzip (.gz), zstd (.zst) or bzip2 (.bz2) are decompressed as they're read. Can be repeated, and each one can be a glob pattern (e.g., \"data/*.json\") or a directory, whose files are read recursively. The files are processed one after the other, as if they were a single file"},
+		&cli.StringFlag{Name: inputOrderFlagPropName, Required: false, Value: inbound.OrderByName, Usage: fmt.Sprintf("Only used with %s. Order in which the input files are processed, one of %v: by path, or by the timestamp of their first event", inputFileFlagPropName, inbound.AvailableOrders)},
+		&cli.BoolFlag{Name: mergeFlagPropName, Required: false, Usage: "Only used with " + inputFileFlagPropName + ". Merge the events of the input files in the order of their timestamps, instead of processing the files one after the other. Each file must be ordered by timestamp"},
+		&cli.StringFlag{Name: inputQueueFlagPropName, Required: false, Usage: "SQS Queue URL that contains input events"},
+		&cli.StringFlag{Name: outputFolderFlagPropName, Required: false, Usage: "Output folder to write output event files"},
+		&cli.StringFlag{Name: groupByFlagPropName, Required: false, Usage: "Comma separated list of dimensions used to calculate an independent aggregation per group (e.g., client_name or source_language,target_language)"},
+		&cli.DurationFlag{Name: gracePeriodFlagPropName, Required: false, Usage: "Only used with " + inputQueueFlagPropName + ". If > 0, time-buckets are written every minute based on the wall-clock once this grace period (e.g., 30s) has passed after their end, even if no events arrive"},
+		&cli.StringFlag{Name: stateFileFlagPropName, Required: false, Usage: "File where the state is checkpointed. With " + inputQueueFlagPropName + " it's restored on startup, with " + inputFileFlagPropName + " only when using " + resumeFlagPropName},
+		&cli.DurationFlag{Name: checkpointFlagPropName, Required: false, Value: time.Minute, Usage: "Only used with " + stateFileFlagPropName + ". How often (e.g., 30s) the state is checkpointed. Messages are only deleted from the queue after being checkpointed, so it must be shorter than the queue visibility timeout"},
+		&cli.DurationFlag{Name: dedupWindowFlagPropName, Required: false, Usage: "If > 0, events whose translation_id was already seen in this time (e.g., 1h) are dropped as duplicates"},
+		&cli.StringFlag{Name: filterFlagPropName, Required: false, Usage: "Only process the events that match this expression over their fields (e.g., client_name == \"airliberty\" && nr_words > 50). Supports ==, !=, <, <=, >, >=, &&, ||, ! and parentheses"},
+		&cli.IntFlag{Name: pollersFlagPropName, Required: false, Value: 1, Usage: "Only used with " + inputQueueFlagPropName + ". Number of pollers receiving and processing messages from the queue concurrently"},
+		&cli.IntFlag{Name: workersFlagPropName, Required: false, Value: 1, Usage: "Only used with " + inputFileFlagPropName + ". If > 1, the file is read, decoded by this number of workers, aggregated and written concurrently in a pipeline"},
+		&cli.BoolFlag{Name: drainFlagPropName, Required: false, Usage: "Only used with " + inputFileFlagPropName + ". At the end of the file, keep writing time-buckets until the windows are empty, so that the last events are part of as many windows as the others"},
+		&cli.StringFlag{Name: untilFlagPropName, Required: false, Usage: "Only used with " + inputFileFlagPropName + ". At the end of the file, keep writing time-buckets until this time (e.g., \"2018-12-27 00:00:00\"), so that reports for a fixed period are complete"},
+		&cli.BoolFlag{Name: resumeFlagPropName, Required: false, Usage: "Only used with " + inputFileFlagPropName + " and " + stateFileFlagPropName + ". Continue processing the file from the last checkpoint, appending to the existing output"},
+	}
+}
+
+// windowFlags returns the flags shared by all the commands that aggregate events over a window
+func windowFlags() []cli.Flag {
+	return append(commonFlags(),
+		&cli.StringFlag{Name: windowTypeFlagPropName, Required: false, Value: application.WindowTypeSliding, Usage: fmt.Sprintf("Type of window, one of %v", application.AvailableWindowTypes)},
+		&cli.StringFlag{Name: windowSizeFlagPropName, Required: false, Usage: "Moving window size in minutes. Either " + windowSizeFlagPropName + " or " + windowFlagPropName + " must be provided, except for session windows. Sliding and hopping windows accept a comma separated list of sizes (e.g., 5,15,60), which are aggregated at once"},
+		&cli.StringFlag{Name: windowFlagPropName, Required: false, Usage: "Moving window size as a duration (e.g., 15m), must be a multiple of " + bucketFlagPropName + ". Sliding and hopping windows accept a comma separated list of sizes (e.g., 5m,15m,1h)"},
+		&cli.DurationFlag{Name: latenessFlagPropName, Required: false, Usage: "How late (e.g., 5m) an event can arrive compared to the most recent one and still be aggregated. Time-buckets are only written once this time has passed. Later events are written to a separate rejected output"},
+		&cli.BoolFlag{Name: skipEmptyFlagPropName, Required: false, Usage: "Only write the first of consecutive time-buckets whose window has no events"},
+		&cli.DurationFlag{Name: hopFlagPropName, Required: false, Usage: "Only used with hopping windows. How often (e.g., 1h) the window is written, must be a multiple of " + bucketFlagPropName},
+		&cli.DurationFlag{Name: sessionGapFlagPropName, Required: false, Usage: "Only used with session windows. Time (e.g., 30m) without events of a group after which its session ends"},
+	)
+}
+
+// initCmd parses the common flags and sets up the storer. The svc must be set up by each command.
+func initCmd(ctx *cli.Context) (cmdCfg, error) {
+	logger, ok := ctx.App.Metadata["Logger"].(logs.Logger)
+	if !ok {
+		return cmdCfg{}, errors.New("could not get logger")
+	}
+
+	var inputPaths []string
+	for _, path := range ctx.StringSlice(inputFileFlagPropName) {
+		if path = strings.TrimSpace(path); path != "" {
+			inputPaths = append(inputPaths, path)
+		}
+	}
+	outputFolder := ctx.String(outputFolderFlagPropName)
+	queueURL := ctx.String(inputQueueFlagPropName)
+
+	bucket := ctx.Duration(bucketFlagPropName)
+	if bucket < time.Second || bucket%time.Second != 0 {
+		return cmdCfg{}, fmt.Errorf("%s must be a whole number of seconds", bucketFlagPropName)
+	}
+
+	groupBy, err := parseGroupBy(ctx.String(groupByFlagPropName))
+	if err != nil {
+		return cmdCfg{}, err
+	}
+
+	gracePeriod := ctx.Duration(gracePeriodFlagPropName)
+	if gracePeriod < 0 {
+		return cmdCfg{}, fmt.Errorf("%s cannot be negative", gracePeriodFlagPropName)
+	}
+
+	outputFolder = strings.TrimSpace(outputFolder)
+	queueURL = strings.TrimSpace(queueURL)
+
+	if len(inputPaths) == 0 && queueURL == "" {
+		return cmdCfg{}, errors.New("must provide either input file or queue URL")
+	}
+	if len(inputPaths) > 0 && queueURL != "" {
+		return cmdCfg{}, errors.New("cannot provide both input file and queue URL")
+	}
+
+	var inputFiles []string
+	if len(inputPaths) > 0 {
+		inputFiles, err = inbound.ListInputFiles(inputPaths, strings.TrimSpace(ctx.String(inputOrderFlagPropName)))
+		if err != nil {
+			return cmdCfg{}, err
+		}
+	}
+
+	var storer storer
+	var fileWriter *outbound.FileWriter
+	if outputFolder != "" {
+		fileWriter = outbound.NewFileWriter(logger, outputFolder)
+		storer = fileWriter
+	} else {
+		logger.Warn("Output folder not provided, writing to stdout instead")
+		storer = outbound.NewStdOut()
+	}
+
+	// the output files are rolled back to the last checkpoint, so that they're not duplicated when restoring it
+	var stateStorer outboundprt.StateStorer
+	if stateFile := strings.TrimSpace(ctx.String(stateFileFlagPropName)); stateFile != "" {
+		stateStorer = outbound.NewStateFile(stateFile, fileWriter)
+	}
+
+	checkpointInterval := ctx.Duration(checkpointFlagPropName)
+	if stateStorer != nil && checkpointInterval <= 0 {
+		return cmdCfg{}, fmt.Errorf("%s must be positive", checkpointFlagPropName)
+	}
+
+	resume := ctx.Bool(resumeFlagPropName)
+	if resume && (len(inputFiles) == 0 || stateStorer == nil) {
+		return cmdCfg{}, fmt.Errorf("%s can only be used with %s and %s", resumeFlagPropName, inputFileFlagPropName, stateFileFlagPropName)
+	}
+
+	workers := ctx.Int(workersFlagPropName)
+	if workers < 1 {
+		return cmdCfg{}, fmt.Errorf("%s must be at least 1", workersFlagPropName)
+	}
+
+	merge := ctx.Bool(mergeFlagPropName)
+	if merge && len(inputFiles) == 0 {
+		return cmdCfg{}, fmt.Errorf("%s can only be used with %s", mergeFlagPropName, inputFileFlagPropName)
+	}
+	if merge && workers > 1 {
+		return cmdCfg{}, fmt.Errorf("cannot provide both %s and %s", mergeFlagPropName, workersFlagPropName)
+	}
+
+	inputMode := inbound.InputModeFiles
+	if merge {
+		inputMode = inbound.InputModeMerge
+	} else if queueURL != "" {
+		inputMode = inbound.InputModeQueue
+	}
+
+	dedupWindow := ctx.Duration(dedupWindowFlagPropName)
+	if dedupWindow < 0 {
+		return cmdCfg{}, fmt.Errorf("%s cannot be negative", dedupWindowFlagPropName)
+	}
+
+	drain := ctx.Bool(drainFlagPropName)
+	until, err := parseTimeFlag(ctx, untilFlagPropName)
+	if err != nil {
+		return cmdCfg{}, err
+	}
+	if (drain || !until.IsZero()) && len(inputFiles) == 0 {
+		return cmdCfg{}, fmt.Errorf("%s and %s can only be used with %s", drainFlagPropName, untilFlagPropName, inputFileFlagPropName)
+	}
+	if drain && !until.IsZero() {
+		return cmdCfg{}, fmt.Errorf("cannot provide both %s and %s", drainFlagPropName, untilFlagPropName)
+	}
+
+	pollers := ctx.Int(pollersFlagPropName)
+	if pollers < 1 {
+		return cmdCfg{}, fmt.Errorf("%s must be at least 1", pollersFlagPropName)
+	}
+
+	if workers > 1 && len(inputFiles) > 0 {
+		// the output is written by a separate goroutine, which also stores the state once the output before it is written
+		async := outbound.NewAsyncStorer(storer, stateStorer, asyncBufferSize)
+		storer = async
+		if stateStorer != nil {
+			stateStorer = async
+		}
+	}
+
+	cfg := cmdCfg{
+		logger:       logger,
+		bucket:       bucket,
+		groupBy:      groupBy,
+		gracePeriod:  gracePeriod,
+		queueURL:     queueURL,
+		inputFiles:   inputFiles,
+		merge:        merge,
+		inputMode:    inputMode,
+		outputFolder: outputFolder,
+		storer:       storer,
+		stateStorer:  stateStorer,
+		resume:       resume,
+		dedupWindow:  dedupWindow,
+		filter:       ctx.String(filterFlagPropName),
+		pollers:      pollers,
+		workers:      workers,
+		drain:        drain,
+		until:        until,
+	}
+	if stateStorer != nil {
+		cfg.checkpointInterval = checkpointInterval
+	}
+
+	return cfg, nil
+}
+
+// initWindowCmd parses the common flags and the window flags, and sets up the storer. The svc must be set up by each
+// command.
+func initWindowCmd(ctx *cli.Context) (cmdCfg, error) {
+	cfg, err := initCmd(ctx)
+	if err != nil {
+		return cmdCfg{}, err
+	}
+
+	cfg.windowType = strings.TrimSpace(ctx.String(windowTypeFlagPropName))
+	if !application.IsWindowType(cfg.windowType) {
+		return cmdCfg{}, fmt.Errorf("invalid %s %q, must be one of %v", windowTypeFlagPropName, cfg.windowType, application.AvailableWindowTypes)
+	}
+
+	if cfg.windowType == application.WindowTypeSession {
+		cfg.sessionGap = ctx.Duration(sessionGapFlagPropName)
+		if cfg.sessionGap <= 0 {
+			return cmdCfg{}, fmt.Errorf("%s must be positive with %s windows", sessionGapFlagPropName, cfg.windowType)
+		}
+	} else {
+		cfg.windows, err = parseWindows(ctx, cfg.logger, cfg.bucket)
+		if err != nil {
+			return cmdCfg{}, err
+		}
+		if len(cfg.windows) > 1 && cfg.windowType == application.WindowTypeTumbling {
+			return cmdCfg{}, fmt.Errorf("%s windows cannot have several sizes", cfg.windowType)
+		}
+		for _, window := range cfg.windows {
+			cfg.windowSizes = append(cfg.windowSizes, int(window/cfg.bucket))
+		}
+	}
+
+	if cfg.windowType == application.WindowTypeHopping {
+		cfg.hop = ctx.Duration(hopFlagPropName)
+		if cfg.hop < cfg.bucket || cfg.hop%cfg.bucket != 0 {
+			return cmdCfg{}, fmt.Errorf("%s (%s) must be a multiple of %s (%s)", hopFlagPropName, cfg.hop, bucketFlagPropName, cfg.bucket)
+		}
+	}
+
+	cfg.allowedLateness = ctx.Duration(latenessFlagPropName)
+	if cfg.allowedLateness < 0 {
+		return cmdCfg{}, fmt.Errorf("%s cannot be negative", latenessFlagPropName)
+	}
+
+	cfg.skipEmpty = ctx.Bool(skipEmptyFlagPropName)
+
+	cfg.logger.Infow("Aggregating events over a window",
+		windowTypeFlagPropName, cfg.windowType,
+		windowFlagPropName, cfg.windows,
+		hopFlagPropName, cfg.hop,
+		sessionGapFlagPropName, cfg.sessionGap,
+		latenessFlagPropName, cfg.allowedLateness,
+		skipEmptyFlagPropName, cfg.skipEmpty)
+
+	return cfg, nil
+}
+
+// decorate wraps the svc of a command with the optional stages that process the events before it, and with the Router
+// that dispatches the events read by the inbound adapters by their name. It returns an error if the flags of the stages
+// are not valid.
+func decorate(cfg cmdCfg, svc application.Calculator) (inboundprt.EventRouter, error) {
+	if cfg.dedupWindow > 0 {
+		svc = application.NewDeduplicator(application.Config{
+			DedupWindow:    cfg.dedupWindow,
+			RejectedStorer: cfg.storer,
+			StateStorer:    cfg.stateStorer,
+		}, svc)
+	}
+	// events are filtered first, so that the ones filtered out are not kept to detect duplicates
+	if cfg.filter != "" {
+		var err error
+		svc, err = application.NewFilter(application.Config{StateStorer: cfg.stateStorer}, cfg.filter, svc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return application.NewRouter(application.Config{
+		RejectedStorer: cfg.storer,
+		StateStorer:    cfg.stateStorer,
+	}, svc), nil
+}
+
+// runCmd processes the events from the configured input with cfg.svc. An interrupt (e.g., Ctrl-C) or a SIGTERM stops
+// the processing cleanly: the output stored so far is kept, and the summary of the processed events is logged. It then
+// returns an error with the cancelledExitCode, so that the caller can tell the input wasn't processed entirely.
+func runCmd(ctx *cli.Context, cfg cmdCfg) error {
+	defer closer.Close(cfg.logger, cfg.storer)
+
+	var stop context.CancelFunc
+	ctx.Context, stop = signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// files are processed from the start unless resuming, in which case the checkpoint has the offset to resume from
+	var offset int64
+	var err error
+	if cfg.queueURL != "" || cfg.resume {
+		offset, err = cfg.svc.Restore(ctx.Context)
+		if err != nil {
+			return fmt.Errorf("could not restore state: %w", err)
+		}
+	}
+
+	if len(cfg.inputFiles) > 0 {
+		err = processFromFile(ctx, cfg, offset)
+	} else if cfg.queueURL != "" {
+		err = processFromQueue(ctx, cfg)
+	}
+
+	if errors.Is(err, context.Canceled) {
+		cfg.logger.Infow("Processing cancelled",
+			"command", ctx.Command.Name,
+			"error", err,
+			"summary", cfg.svc.Summary())
+		return cli.Exit("processing cancelled", cancelledExitCode)
+	} else if err != nil {
+		return fmt.Errorf("error processing input: %w", err)
+	}
+	return nil
+}
+
+func processFromFile(ctx *cli.Context, cfg cmdCfg, offset int64) error {
+	cfg.logger.Infow("Running command from file",
+		"command", ctx.Command.Name,
+		inputFileFlagPropName, cfg.inputFiles,
+		mergeFlagPropName, cfg.merge,
+		bucketFlagPropName, cfg.bucket,
+		groupByFlagPropName, cfg.groupBy,
+		checkpointFlagPropName, cfg.checkpointInterval,
+		workersFlagPropName, cfg.workers,
+		drainFlagPropName, cfg.drain,
+		untilFlagPropName, cfg.until,
+		"offset", offset,
+		"restored_summary", cfg.svc.Summary())
+
+	start := time.Now()
+	fileProcessor := inbound.NewFileProcessor(cfg.logger, cfg.svc, cfg.checkpointInterval, cfg.workers, cfg.drain, cfg.until)
+
+	var err error
+	if cfg.merge {
+		err = fileProcessor.MergeMovingAverageFromFiles(ctx.Context, cfg.inputFiles, offset)
+	} else {
+		err = fileProcessor.CalculateMovingAverageFromFiles(ctx.Context, cfg.inputFiles, offset)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the output may still be buffered, and the processing only succeeded once it's written
+	if async, ok := cfg.storer.(*outbound.AsyncStorer); ok {
+		if err = async.Flush(ctx.Context); err != nil {
+			return fmt.Errorf("could not write output: %w", err)
+		}
+	}
+
+	elapsed := time.Since(start)
+	cfg.logger.Infow("Successfully processed events from file",
+		"command", ctx.Command.Name,
+		"time", elapsed,
+		"summary", cfg.svc.Summary())
+	return nil
+}
+
+func processFromQueue(ctx *cli.Context, cfg cmdCfg) error {
+	cfg.logger.Infow("Running command from SQS Queue",
+		"command", ctx.Command.Name,
+		inputQueueFlagPropName, cfg.queueURL,
+		bucketFlagPropName, cfg.bucket,
+		groupByFlagPropName, cfg.groupBy,
+		gracePeriodFlagPropName, cfg.gracePeriod,
+		checkpointFlagPropName, cfg.checkpointInterval,
+		pollersFlagPropName, cfg.pollers,
+		"restored_summary", cfg.svc.Summary())
+
+	awsCfg, err := awsConfig.LoadDefaultConfig(ctx.Context)
+	if err != nil {
+		return errors.New("could not load AWS default config: " + err.Error())
+	}
+
+	sqsClient := awsSqs.NewFromConfig(awsCfg)
+
+	// the messages of each poll are processed as a batch, and SQS returns at most 10 at once
+	queueCfg := sqs.ConfigSQS{
+		Logger:              cfg.logger,
+		SqsClient:           sqsClient,
+		SqsURL:              cfg.queueURL,
+		MaxNumberOfMessages: 10,
+		WaitTimeSeconds:     15,
+	}
+	q := sqs.NewClient(queueCfg)
+
+	// several pollers share the svc, so it's owned by a single goroutine that runs their calls one at a time
+	svc := cfg.svc
+	if cfg.pollers > 1 {
+		concurrent := application.NewConcurrent(cfg.svc)
+		defer closer.Close(cfg.logger, concurrent)
+		svc = concurrent
+	}
+
+	queueConsumer := inbound.NewQueueConsumer(cfg.logger, q, svc, cfg.bucket, cfg.gracePeriod, cfg.checkpointInterval, cfg.pollers)
+	cfg.logger.Info("Message poller starting...")
+	return queueConsumer.PollAndProcess(ctx.Context)
+}
+
+// parseWindows returns the durations of the windows, which can be provided either in minutes (window_size) or as
+// durations (window), as a comma separated list. Each one must be a multiple of the duration of each time-bucket.
+func parseWindows(ctx *cli.Context, logger logs.Logger, bucket time.Duration) ([]time.Duration, error) {
+	var windows []time.Duration
+	switch {
+	case ctx.IsSet(windowSizeFlagPropName) && ctx.IsSet(windowFlagPropName):
+		return nil, fmt.Errorf("cannot provide both %s and %s", windowSizeFlagPropName, windowFlagPropName)
+	case ctx.IsSet(windowFlagPropName):
+		for _, value := range strings.Split(ctx.String(windowFlagPropName), ",") {
+			window, err := time.ParseDuration(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", windowFlagPropName, value, err)
+			}
+			windows = append(windows, window)
+		}
+	case ctx.IsSet(windowSizeFlagPropName):
+		for _, value := range strings.Split(ctx.String(windowSizeFlagPropName), ",") {
+			windowSize, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", windowSizeFlagPropName, value, err)
+			}
+			if windowSize < 1 {
+				logger.Warnw("window size cannot be < 1, using default value of 10")
+				windowSize = 10
+			}
+			windows = append(windows, time.Duration(windowSize)*time.Minute)
+		}
+	default:
+		return nil, fmt.Errorf("must provide either %s or %s", windowSizeFlagPropName, windowFlagPropName)
+	}
+
+	seen := map[time.Duration]bool{}
+	for _, window := range windows {
+		if window < bucket || window%bucket != 0 {
+			return nil, fmt.Errorf("%s (%s) must be a multiple of %s (%s)", windowFlagPropName, window, bucketFlagPropName, bucket)
+		}
+		if seen[window] {
+			return nil, fmt.Errorf("%s (%s) is provided more than once", windowFlagPropName, window)
+		}
+		seen[window] = true
+	}
+	return windows, nil
+}
+
+// parseTimeFlag parses the value of a flag with the same format as the timestamps of the events. It returns the zero
+// time if the flag isn't provided.
+func parseTimeFlag(ctx *cli.Context, name string) (time.Time, error) {
+	value := strings.TrimSpace(ctx.String(name))
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := domain.ParseTime(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return parsed.Time, nil
+}
+
+// parseGroupBy parses a comma separated list of dimensions, validating that each one of them exists
+func parseGroupBy(value string) ([]string, error) {
+	var groupBy []string
+	for _, dimension := range strings.Split(value, ",") {
+		dimension = strings.TrimSpace(dimension)
+		if dimension == "" {
+			continue
+		}
+		if !domain.IsDimension(dimension) {
+			return nil, fmt.Errorf("invalid %s dimension %q, must be one of %v", groupByFlagPropName, dimension, domain.Dimensions)
+		}
+		groupBy = append(groupBy, dimension)
+	}
+	return groupBy, nil
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/lucaslobo/aggregator/internal/core/application"
+)
+
+const (
+	halfLifeFlagPropName = "half_life"
+)
+
+// ExponentialMovingAverageCommand is the command to calculate the exponential moving average aggregation.
+var ExponentialMovingAverageCommand = &cli.Command{
+	Name:   "exponential-moving-average",
+	Action: runExponentialMovingAverageCommand,
+	Flags: append(commonFlags(),
+		&cli.DurationFlag{Name: halfLifeFlagPropName, Required: false, Value: 10 * time.Minute, Usage: "Time (e.g., 10m) after which the weight of an event in the average is halved"},
+	),
+}
+
+func runExponentialMovingAverageCommand(ctx *cli.Context) error {
+	cfg, err := initCmd(ctx)
+	if err != nil {
+		return err
+	}
+
+	halfLife := ctx.Duration(halfLifeFlagPropName)
+	if halfLife <= 0 {
+		return fmt.Errorf("%s must be positive", halfLifeFlagPropName)
+	}
+
+	cfg.logger.Infow("Calculating exponential moving average", halfLifeFlagPropName, halfLife)
+
+	cfg.svc, err = decorate(cfg, application.NewExponentialMovingAverage(application.Config{
+		Bucket:         cfg.bucket,
+		GroupBy:        cfg.groupBy,
+		RejectedStorer: cfg.storer,
+		StateStorer:    cfg.stateStorer,
+		InputMode:      cfg.inputMode,
+	}, halfLife, cfg.storer))
+	if err != nil {
+		return err
+	}
+
+	return runCmd(ctx, cfg)
+}
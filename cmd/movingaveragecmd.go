@@ -1,169 +1,122 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
 	"strings"
 	"time"
 
-	awsConfig "github.com/aws/aws-sdk-go-v2/config"
-	awsSqs "github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/urfave/cli/v2"
 
-	"github.com/lucaslobo/aggregator/internal/common/closer"
-	"github.com/lucaslobo/aggregator/internal/common/logs"
-	"github.com/lucaslobo/aggregator/internal/common/sqs"
 	"github.com/lucaslobo/aggregator/internal/core/application"
-	"github.com/lucaslobo/aggregator/internal/core/inboundprt"
-	"github.com/lucaslobo/aggregator/internal/core/outboundprt"
-	"github.com/lucaslobo/aggregator/internal/inbound"
-	"github.com/lucaslobo/aggregator/internal/outbound"
 )
 
 const (
-	// prop names are used to identify values for the CLI commands
-	windowSizeFlagPropName   = "window_size"
-	inputFileFlagPropName    = "input_file"
-	outputFolderFlagPropName = "output_folder"
-	inputQueueFlagPropName   = "queue_url"
+	metricsFlagPropName  = "metrics"
+	weightedFlagPropName = "weighted"
+	fromFlagPropName     = "from"
+	toFlagPropName       = "to"
 )
 
-type cmdCfg struct {
-	logger logs.Logger
-
-	windowSize   int
-	queueURL     string
-	inputFile    string
-	outputFolder string
-
-	storer outboundprt.MovingAverageStorer
-	svc    inboundprt.MovingAverageCalculator
-}
-
 // MovingAverageCommand is the command to calculate the moving average aggregation from a file.
 var MovingAverageCommand = &cli.Command{
 	Name:   "moving-average",
 	Action: runMovingAverageCommand,
-	Flags: []cli.Flag{
-		&cli.IntFlag{Name: windowSizeFlagPropName, Required: true, Usage: "Moving average window size in minutes"},
-		&cli.StringFlag{Name: inputFileFlagPropName, Required: false, Usage: "File (.json) that contains input events"},
-		&cli.StringFlag{Name: inputQueueFlagPropName, Required: false, Usage: "SQS Queue URL that contains input events"},
-		&cli.StringFlag{Name: outputFolderFlagPropName, Required: false, Usage: "Output folder to write output event files"},
-	},
+	Flags: append(windowFlags(),
+		&cli.StringFlag{Name: metricsFlagPropName, Required: false, Usage: fmt.Sprintf("Comma separated list of metrics to calculate besides the average, any of %v", application.AvailableMetrics)},
+		&cli.BoolFlag{Name: weightedFlagPropName, Required: false, Usage: "Weight the delivery time of each event by its number of words when calculating the average"},
+		&cli.StringFlag{Name: fromFlagPropName, Required: false, Usage: "Only used with " + inputFileFlagPropName + ". Start the output at this time (e.g., \"2018-12-26 00:00:00\"), even if the first event is later. Earlier events are dropped"},
+		&cli.StringFlag{Name: toFlagPropName, Required: false, Usage: "Only used with " + inputFileFlagPropName + ". End the output at this time (e.g., \"2018-12-27 00:00:00\"), even if the last event is earlier. Events at or after it are dropped"},
+	),
 }
 
 func runMovingAverageCommand(ctx *cli.Context) error {
-	cfg, err := initCmd(ctx)
+	cfg, err := initWindowCmd(ctx)
 	if err != nil {
 		return err
 	}
 
-	defer closer.Close(cfg.logger, cfg.storer)
-
-	if cfg.inputFile != "" {
-		err = processFromFile(ctx, cfg)
-	} else if cfg.queueURL != "" {
-		err = processFromQueue(ctx, cfg)
-	}
-
+	metrics, err := parseMetrics(ctx.String(metricsFlagPropName))
 	if err != nil {
-		return fmt.Errorf("error processing input: %w", err)
-	}
-	return nil
-}
-
-func initCmd(ctx *cli.Context) (cmdCfg, error) {
-	logger, ok := ctx.App.Metadata["Logger"].(logs.Logger)
-	if !ok {
-		return cmdCfg{}, errors.New("could not get logger")
-	}
-
-	inputFile := ctx.String(inputFileFlagPropName)
-	outputFolder := ctx.String(outputFolderFlagPropName)
-	queueURL := ctx.String(inputQueueFlagPropName)
-	windowSize := ctx.Int(windowSizeFlagPropName)
-
-	if windowSize < 1 {
-		logger.Warnw("window size cannot be < 1, using default value of 10")
-		windowSize = 10
+		return err
 	}
 
-	inputFile = strings.TrimSpace(inputFile)
-	outputFolder = strings.TrimSpace(outputFolder)
-	queueURL = strings.TrimSpace(queueURL)
-
-	if inputFile == "" && queueURL == "" {
-		return cmdCfg{}, errors.New("must provide either input file or queue URL")
-	}
-	if inputFile != "" && queueURL != "" {
-		return cmdCfg{}, errors.New("cannot provide both input file and queue URL")
+	from, to, err := parseRange(ctx, &cfg)
+	if err != nil {
+		return err
 	}
 
-	var storer outboundprt.MovingAverageStorer
-	if outputFolder != "" {
-		storer = outbound.NewFileWriter(logger, outputFolder)
-	} else {
-		logger.Warn("Output folder not provided, writing to stdout instead")
-		storer = outbound.NewStdOut()
+	cfg.svc, err = decorate(cfg, application.New(application.Config{
+		WindowType:      cfg.windowType,
+		WindowSizes:     cfg.windowSizes,
+		Hop:             cfg.hop,
+		SessionGap:      cfg.sessionGap,
+		Bucket:          cfg.bucket,
+		GroupBy:         cfg.groupBy,
+		Metrics:         metrics,
+		Weighted:        ctx.Bool(weightedFlagPropName),
+		SkipEmpty:       cfg.skipEmpty,
+		From:            from,
+		To:              to,
+		AllowedLateness: cfg.allowedLateness,
+		RejectedStorer:  cfg.storer,
+		StateStorer:     cfg.stateStorer,
+		InputMode:       cfg.inputMode,
+	}, cfg.storer))
+	if err != nil {
+		return err
 	}
 
-	svc := application.New(windowSize, storer)
+	return runCmd(ctx, cfg)
+}
 
-	cfg := cmdCfg{
-		logger:       logger,
-		windowSize:   windowSize,
-		queueURL:     queueURL,
-		inputFile:    inputFile,
-		outputFolder: outputFolder,
-		storer:       storer,
-		svc:          svc,
+// parseMetrics parses a comma separated list of metrics, validating that each one of them exists
+func parseMetrics(value string) ([]string, error) {
+	var metrics []string
+	seen := map[string]bool{}
+	for _, metric := range strings.Split(value, ",") {
+		metric = strings.TrimSpace(metric)
+		if metric == "" || seen[metric] {
+			continue
+		}
+		if !application.IsMetric(metric) {
+			return nil, fmt.Errorf("invalid %s metric %q, must be one of %v", metricsFlagPropName, metric, application.AvailableMetrics)
+		}
+		seen[metric] = true
+		metrics = append(metrics, metric)
 	}
-
-	return cfg, nil
+	return metrics, nil
 }
 
-func processFromFile(_ *cli.Context, cfg cmdCfg) error {
-	cfg.logger.Infow("Running Moving Average Command from file",
-		inputFileFlagPropName, cfg.inputFile,
-		windowSizeFlagPropName, cfg.windowSize)
-
-	start := time.Now()
-	fileProcessor := inbound.NewFileProcessor(cfg.logger, cfg.svc)
-
-	err := fileProcessor.CalculateMovingAverageFromFile(cfg.inputFile)
+// parseRange parses the time range of the output. The windows are advanced until its end once the input file is
+// processed, the same way as with the until flag, which can't be used along with it.
+func parseRange(ctx *cli.Context, cfg *cmdCfg) (time.Time, time.Time, error) {
+	from, err := parseTimeFlag(ctx, fromFlagPropName)
 	if err != nil {
-		return err
+		return time.Time{}, time.Time{}, err
 	}
-
-	elapsed := time.Since(start)
-	cfg.logger.Infow("Successfully calculated moving average from file", "time", elapsed)
-	return nil
-}
-
-func processFromQueue(ctx *cli.Context, cfg cmdCfg) error {
-	cfg.logger.Infow("Running Moving Average Command from SQS Queue",
-		inputFileFlagPropName, cfg.queueURL,
-		windowSizeFlagPropName, cfg.windowSize)
-
-	awsCfg, err := awsConfig.LoadDefaultConfig(ctx.Context)
+	to, err := parseTimeFlag(ctx, toFlagPropName)
 	if err != nil {
-		return errors.New("could not load AWS default config: " + err.Error())
+		return time.Time{}, time.Time{}, err
 	}
-
-	sqsClient := awsSqs.NewFromConfig(awsCfg)
-
-	queueCfg := sqs.ConfigSQS{
-		Logger:              cfg.logger,
-		SqsClient:           sqsClient,
-		SqsURL:              cfg.queueURL,
-		MaxNumberOfMessages: 1,
-		WaitTimeSeconds:     15,
+	if from.IsZero() && to.IsZero() {
+		return from, to, nil
 	}
-	q := sqs.NewClient(queueCfg)
 
-	queueConsumer := inbound.NewQueueConsumer(cfg.logger, q, cfg.svc)
-	cfg.logger.Info("Message poller starting...")
-	queueConsumer.PollAndProcess(ctx.Context)
+	if len(cfg.inputFiles) == 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s and %s can only be used with %s", fromFlagPropName, toFlagPropName, inputFileFlagPropName)
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s must be before %s", fromFlagPropName, toFlagPropName)
+	}
+	if !to.IsZero() {
+		if cfg.drain || !cfg.until.IsZero() {
+			return time.Time{}, time.Time{}, fmt.Errorf("cannot provide %s along with %s or %s", toFlagPropName, drainFlagPropName, untilFlagPropName)
+		}
+		cfg.until = to
+	}
 
-	return nil
+	cfg.logger.Infow("Aggregating events in a time range",
+		fromFlagPropName, from,
+		toFlagPropName, to)
+	return from, to, nil
 }
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/lucaslobo/aggregator/internal/core/application"
+)
+
+const (
+	percentilesFlagPropName      = "percentiles"
+	relativeAccuracyFlagPropName = "relative_accuracy"
+)
+
+// MovingPercentileCommand is the command to calculate the moving percentiles of the delivery time.
+var MovingPercentileCommand = &cli.Command{
+	Name:   "moving-percentile",
+	Action: runMovingPercentileCommand,
+	Flags: append(windowFlags(),
+		&cli.StringFlag{Name: percentilesFlagPropName, Required: false, Value: "50,90,99", Usage: "Comma separated list of percentiles to calculate (0 < p <= 100)"},
+		&cli.Float64Flag{Name: relativeAccuracyFlagPropName, Required: false, Usage: "If > 0, percentiles are approximated with the given relative accuracy (e.g., 0.01) using bounded memory, which is recommended for large windows. Exact percentiles are calculated otherwise"},
+	),
+}
+
+func runMovingPercentileCommand(ctx *cli.Context) error {
+	cfg, err := initWindowCmd(ctx)
+	if err != nil {
+		return err
+	}
+
+	percentiles, err := parsePercentiles(ctx.String(percentilesFlagPropName))
+	if err != nil {
+		return err
+	}
+
+	relativeAccuracy := ctx.Float64(relativeAccuracyFlagPropName)
+	if relativeAccuracy < 0 || relativeAccuracy >= 1 {
+		return fmt.Errorf("%s must be >= 0 and < 1", relativeAccuracyFlagPropName)
+	}
+
+	cfg.logger.Infow("Calculating percentiles",
+		percentilesFlagPropName, percentiles,
+		relativeAccuracyFlagPropName, relativeAccuracy)
+
+	cfg.svc, err = decorate(cfg, application.NewPercentile(application.Config{
+		WindowType:       cfg.windowType,
+		WindowSizes:      cfg.windowSizes,
+		Hop:              cfg.hop,
+		SessionGap:       cfg.sessionGap,
+		Bucket:           cfg.bucket,
+		GroupBy:          cfg.groupBy,
+		Percentiles:      percentiles,
+		RelativeAccuracy: relativeAccuracy,
+		SkipEmpty:        cfg.skipEmpty,
+		AllowedLateness:  cfg.allowedLateness,
+		RejectedStorer:   cfg.storer,
+		StateStorer:      cfg.stateStorer,
+		InputMode:        cfg.inputMode,
+	}, cfg.storer))
+	if err != nil {
+		return err
+	}
+
+	return runCmd(ctx, cfg)
+}
+
+// parsePercentiles parses a comma separated list of percentiles
+func parsePercentiles(value string) ([]float64, error) {
+	var percentiles []float64
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		percentile, err := strconv.ParseFloat(p, 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return nil, fmt.Errorf("invalid percentile %q, must be a number > 0 and <= 100", p)
+		}
+		percentiles = append(percentiles, percentile)
+	}
+	if len(percentiles) == 0 {
+		return nil, fmt.Errorf("must provide at least one percentile")
+	}
+	return percentiles, nil
+}
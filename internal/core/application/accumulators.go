@@ -0,0 +1,331 @@
+package application
+
+import (
+	"encoding/json"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+)
+
+// accumulator incrementally aggregates the events of a time-bucket, or of all the time-buckets in a window
+type accumulator interface {
+	// add adds one event to the accumulator
+	add(event domain.TranslationDelivered)
+	// merge adds all the events of another accumulator of the same kind
+	merge(other accumulator)
+	// subtract removes the events of another accumulator of the same kind. It returns false if the accumulator cannot
+	// be inverted (e.g., min), in which case the window must rebuild it by merging the buckets that are left.
+	subtract(other accumulator) bool
+	// accumulators are encoded as JSON to checkpoint the state of the windows. They're decoded into a new accumulator
+	// of the same kind.
+	json.Marshaler
+	json.Unmarshaler
+}
+
+// Names of the metrics that can be added to the moving average output
+const (
+	MetricMin   = "min"
+	MetricMax   = "max"
+	MetricSum   = "sum"
+	MetricCount = "count"
+	MetricWords = "words"
+	// MetricSecondsPerWord is the sum of the durations divided by the sum of the words
+	MetricSecondsPerWord = "seconds_per_word"
+)
+
+// AvailableMetrics lists the names of all the metrics that can be added to the moving average output
+var AvailableMetrics = []string{MetricMin, MetricMax, MetricSum, MetricCount, MetricWords, MetricSecondsPerWord}
+
+// metric calculates one or more fields of the moving average output from the events in the window
+type metric struct {
+	// accumulator names the kind of accumulator created by newAccumulator. The metrics with the same one share a
+	// single accumulator in each state (e.g., the average, the sum and the count of the durations).
+	accumulator    string
+	newAccumulator func() accumulator
+	report         func(acc accumulator, out *domain.AverageDeliveryTime)
+}
+
+// newDurationSum creates the accumulator of the sum and the count of the durations
+func newDurationSum() accumulator {
+	return &sumAccumulator{value: duration}
+}
+
+var averageMetric = metric{
+	accumulator:    "duration_sum",
+	newAccumulator: newDurationSum,
+	report: func(acc accumulator, out *domain.AverageDeliveryTime) {
+		sum := acc.(*sumAccumulator)
+		if sum.count != 0 {
+			// let's not divide by 0 ;)
+			out.AverageDeliveryTime = float32(sum.sum) / float32(sum.count)
+		}
+	},
+}
+
+// weightedAverageMetric is the average of the durations weighted by the number of words of each event
+var weightedAverageMetric = metric{
+	accumulator:    "weighted_duration_ratio",
+	newAccumulator: func() accumulator { return &ratioAccumulator{numerator: weightedDuration, denominator: words} },
+	report: func(acc accumulator, out *domain.AverageDeliveryTime) {
+		out.AverageDeliveryTime = acc.(*ratioAccumulator).ratio()
+	},
+}
+
+var metrics = map[string]metric{
+	MetricMin: {
+		accumulator:    "duration_min",
+		newAccumulator: func() accumulator { return &extremeAccumulator{before: func(a, b int) bool { return a < b }} },
+		report: func(acc accumulator, out *domain.AverageDeliveryTime) {
+			out.MinDeliveryTime = acc.(*extremeAccumulator).result()
+		},
+	},
+	MetricMax: {
+		accumulator:    "duration_max",
+		newAccumulator: func() accumulator { return &extremeAccumulator{before: func(a, b int) bool { return a > b }} },
+		report: func(acc accumulator, out *domain.AverageDeliveryTime) {
+			out.MaxDeliveryTime = acc.(*extremeAccumulator).result()
+		},
+	},
+	MetricSum: {
+		accumulator:    "duration_sum",
+		newAccumulator: newDurationSum,
+		report: func(acc accumulator, out *domain.AverageDeliveryTime) {
+			value := acc.(*sumAccumulator).sum
+			out.TotalDeliveryTime = &value
+		},
+	},
+	MetricCount: {
+		accumulator:    "duration_sum",
+		newAccumulator: newDurationSum,
+		report: func(acc accumulator, out *domain.AverageDeliveryTime) {
+			value := acc.(*sumAccumulator).count
+			out.Count = &value
+		},
+	},
+	MetricWords: {
+		accumulator:    "words_sum",
+		newAccumulator: func() accumulator { return &sumAccumulator{value: words} },
+		report: func(acc accumulator, out *domain.AverageDeliveryTime) {
+			value := acc.(*sumAccumulator).sum
+			out.TotalWords = &value
+		},
+	},
+	MetricSecondsPerWord: {
+		accumulator:    "seconds_per_word_ratio",
+		newAccumulator: func() accumulator { return &ratioAccumulator{numerator: duration, denominator: words} },
+		report: func(acc accumulator, out *domain.AverageDeliveryTime) {
+			value := acc.(*ratioAccumulator).ratio()
+			out.SecondsPerWord = &value
+		},
+	},
+}
+
+// IsMetric returns true if name is the name of one of the AvailableMetrics
+func IsMetric(name string) bool {
+	_, ok := metrics[name]
+	return ok
+}
+
+func duration(event domain.TranslationDelivered) int {
+	return event.Duration
+}
+
+func words(event domain.TranslationDelivered) int {
+	return event.NrWords
+}
+
+func weightedDuration(event domain.TranslationDelivered) int {
+	return event.Duration * event.NrWords
+}
+
+// sumAccumulator keeps the number of events and the sum of one of their values
+type sumAccumulator struct {
+	value func(event domain.TranslationDelivered) int
+	count int
+	sum   int
+}
+
+func (s *sumAccumulator) add(event domain.TranslationDelivered) {
+	s.count += 1
+	s.sum += s.value(event)
+}
+
+func (s *sumAccumulator) merge(other accumulator) {
+	o := other.(*sumAccumulator)
+	s.count += o.count
+	s.sum += o.sum
+}
+
+func (s *sumAccumulator) subtract(other accumulator) bool {
+	o := other.(*sumAccumulator)
+	s.count -= o.count
+	s.sum -= o.sum
+	return true
+}
+
+// sumSnapshot is the JSON representation of a sumAccumulator
+type sumSnapshot struct {
+	Count int `json:"count"`
+	Sum   int `json:"sum"`
+}
+
+func (s *sumAccumulator) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sumSnapshot{Count: s.count, Sum: s.sum})
+}
+
+func (s *sumAccumulator) UnmarshalJSON(data []byte) error {
+	var snapshot sumSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	s.count, s.sum = snapshot.Count, snapshot.Sum
+	return nil
+}
+
+// ratioAccumulator keeps the sums of two values of the events, so that their ratio can be calculated
+type ratioAccumulator struct {
+	numerator   func(event domain.TranslationDelivered) int
+	denominator func(event domain.TranslationDelivered) int
+
+	numeratorSum   int
+	denominatorSum int
+}
+
+func (r *ratioAccumulator) add(event domain.TranslationDelivered) {
+	r.numeratorSum += r.numerator(event)
+	r.denominatorSum += r.denominator(event)
+}
+
+func (r *ratioAccumulator) merge(other accumulator) {
+	o := other.(*ratioAccumulator)
+	r.numeratorSum += o.numeratorSum
+	r.denominatorSum += o.denominatorSum
+}
+
+func (r *ratioAccumulator) subtract(other accumulator) bool {
+	o := other.(*ratioAccumulator)
+	r.numeratorSum -= o.numeratorSum
+	r.denominatorSum -= o.denominatorSum
+	return true
+}
+
+// ratio returns the ratio between the sums, or 0 if the denominator is 0
+func (r *ratioAccumulator) ratio() float32 {
+	if r.denominatorSum == 0 {
+		return 0
+	}
+	return float32(r.numeratorSum) / float32(r.denominatorSum)
+}
+
+// ratioSnapshot is the JSON representation of a ratioAccumulator
+type ratioSnapshot struct {
+	Numerator   int `json:"numerator"`
+	Denominator int `json:"denominator"`
+}
+
+func (r *ratioAccumulator) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ratioSnapshot{Numerator: r.numeratorSum, Denominator: r.denominatorSum})
+}
+
+func (r *ratioAccumulator) UnmarshalJSON(data []byte) error {
+	var snapshot ratioSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	r.numeratorSum, r.denominatorSum = snapshot.Numerator, snapshot.Denominator
+	return nil
+}
+
+// extremeAccumulator keeps the duration that comes first according to before (i.e., the min or the max duration)
+type extremeAccumulator struct {
+	before   func(a, b int) bool
+	hasValue bool
+	value    int
+}
+
+// result returns the min or the max duration, or nil if there are no events, so that it's omitted from the output
+func (e *extremeAccumulator) result() *int {
+	if !e.hasValue {
+		return nil
+	}
+	value := e.value
+	return &value
+}
+
+func (e *extremeAccumulator) add(event domain.TranslationDelivered) {
+	e.set(event.Duration)
+}
+
+func (e *extremeAccumulator) merge(other accumulator) {
+	o := other.(*extremeAccumulator)
+	if o.hasValue {
+		e.set(o.value)
+	}
+}
+
+func (e *extremeAccumulator) subtract(accumulator) bool {
+	return false
+}
+
+func (e *extremeAccumulator) set(value int) {
+	if !e.hasValue || e.before(value, e.value) {
+		e.value = value
+		e.hasValue = true
+	}
+}
+
+// MarshalJSON encodes the value, or null if there is none
+func (e *extremeAccumulator) MarshalJSON() ([]byte, error) {
+	if !e.hasValue {
+		return []byte("null"), nil
+	}
+	return json.Marshal(e.value)
+}
+
+func (e *extremeAccumulator) UnmarshalJSON(data []byte) error {
+	var value *int
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	e.hasValue = value != nil
+	if e.hasValue {
+		e.value = *value
+	}
+	return nil
+}
+
+// percentileAccumulator keeps the histogram of the durations of the events
+type percentileAccumulator struct {
+	*histogram
+}
+
+func (p percentileAccumulator) add(event domain.TranslationDelivered) {
+	p.histogram.add(event.Duration)
+}
+
+func (p percentileAccumulator) merge(other accumulator) {
+	p.histogram.merge(other.(percentileAccumulator).histogram)
+}
+
+func (p percentileAccumulator) subtract(other accumulator) bool {
+	p.histogram.subtract(other.(percentileAccumulator).histogram)
+	return true
+}
+
+func (p percentileAccumulator) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.histogram.bins)
+}
+
+// UnmarshalJSON decodes the bins of the histogram. Since they depend on the binning, it must be the same one used to
+// encode them.
+func (p percentileAccumulator) UnmarshalJSON(data []byte) error {
+	bins := map[int]int{}
+	if err := json.Unmarshal(data, &bins); err != nil {
+		return err
+	}
+	p.histogram.bins = bins
+	p.histogram.count = 0
+	for _, count := range bins {
+		p.histogram.count += count
+	}
+	return nil
+}
@@ -1,6 +1,12 @@
 package application
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/lucaslobo/aggregator/internal/core/domain"
@@ -8,96 +14,496 @@ import (
 )
 
 type Application struct {
-	storer outboundprt.MovingAverageStorer
-	sw     *slidingWindow
+	// store stores the aggregation of a window
+	store func(ctx context.Context, r result) error
+	// batch buffers the stored aggregations while a batch of events is processed
+	batch batcher
+	// rejectedStorer stores the events that can't be aggregated (optional)
+	rejectedStorer outboundprt.RejectedEventStorer
+	// stateStorer stores the checkpoints of the state of the windows (optional)
+	stateStorer outboundprt.StateStorer
+	// inputMode identifies what the offsets of the checkpoints count
+	inputMode string
+
+	windowType string
+	// windowSizes holds the sizes of the windows that are aggregated at once. It has a single one, unless several are
+	// configured for sliding or hopping windows.
+	windowSizes []int
+	// windowNames holds the name of each window size (e.g., 15m), which identifies its aggregation in the output
+	windowNames     []string
+	bucket          time.Duration
+	hop             time.Duration
+	sessionGap      time.Duration
+	groupBy         []string
+	allowedLateness time.Duration
+	skipEmpty       bool
+	// metrics holds the names of the cfg.Metrics that are aggregated along with the average, which is weighted when
+	// weighted is true
+	metrics  []string
+	weighted bool
+	// relativeAccuracy is the accuracy of the binning of the percentile histograms, or 0 if they're exact
+	relativeAccuracy float64
+	// from and to limit the events that are aggregated, when not zero
+	from time.Time
+	to   time.Time
+	// accumulators creates the set of accumulators used by each time-bucket
+	accumulators []func() accumulator
+	// windows holds one window per group key
+	windows map[string]window
+
+	summary domain.ProcessingSummary
 }
 
-func New(windowSize int, storer outboundprt.MovingAverageStorer) *Application {
-	return &Application{
-		storer: storer,
-		sw: &slidingWindow{
-			windowSize: windowSize,
-			buckets:    map[time.Time]state{},
-		},
+// New creates an Application that calculates the moving average delivery time, along with the cfg.Metrics
+func New(cfg Config, storer outboundprt.MovingAverageStorer) *Application {
+	reported := []metric{averageMetric}
+	if cfg.Weighted {
+		reported = []metric{weightedAverageMetric}
+	}
+	var names []string
+	for _, name := range cfg.Metrics {
+		if m, ok := metrics[name]; ok {
+			reported = append(reported, m)
+			names = append(names, name)
+		}
+	}
+
+	a := newApplication(cfg)
+	a.metrics = names
+	a.weighted = cfg.Weighted
+	// indices holds the position of the accumulator of each reported metric in the states
+	indices := make([]int, len(reported))
+	positions := map[string]int{}
+	for i, m := range reported {
+		position, ok := positions[m.accumulator]
+		if !ok {
+			position = len(a.accumulators)
+			positions[m.accumulator] = position
+			a.accumulators = append(a.accumulators, m.newAccumulator)
+		}
+		indices[i] = position
 	}
+	output := &outputBatch[domain.AverageDeliveryTime]{
+		store:      storer.StoreMovingAverage,
+		storeSlice: storer.StoreMovingAverageSlice,
+	}
+	a.batch = output
+	report := func(s state, adt *domain.AverageDeliveryTime) {
+		for i, m := range reported {
+			m.report(s[indices[i]], adt)
+		}
+	}
+	a.store = func(ctx context.Context, r result) error {
+		adt := domain.AverageDeliveryTime{
+			Date:        r.date,
+			WindowStart: r.start,
+			Group:       r.group,
+		}
+		report(r.states[0], &adt)
+		if len(r.states) > 1 {
+			adt.Windows = make(map[string]domain.AverageDeliveryTime, len(r.states))
+			for i, s := range r.states {
+				var window domain.AverageDeliveryTime
+				report(s, &window)
+				adt.Windows[a.windowNames[i]] = window
+			}
+		}
+		return output.add(ctx, adt)
+	}
+	a.seedWindow()
+	return a
 }
 
-type state struct {
-	count    int
-	duration int
+// NewPercentile creates an Application that calculates the moving percentiles (cfg.Percentiles) of the delivery time
+func NewPercentile(cfg Config, storer outboundprt.PercentileStorer) *Application {
+	var b binning = exactBinning{}
+	if cfg.RelativeAccuracy > 0 {
+		b = newLogBinning(cfg.RelativeAccuracy)
+	}
+
+	quantiles := make([]float64, len(cfg.Percentiles))
+	names := make([]string, len(cfg.Percentiles))
+	for i, p := range cfg.Percentiles {
+		quantiles[i] = p / 100
+		names[i] = fmt.Sprintf("p%g", p)
+	}
+
+	a := newApplication(cfg)
+	a.relativeAccuracy = max(cfg.RelativeAccuracy, 0)
+	a.accumulators = []func() accumulator{
+		func() accumulator { return percentileAccumulator{newHistogram(b)} },
+	}
+	output := &outputBatch[domain.PercentileDeliveryTime]{
+		store:      storer.StorePercentiles,
+		storeSlice: storer.StorePercentilesSlice,
+	}
+	a.batch = output
+	report := func(s state) map[string]float32 {
+		percentiles := make(map[string]float32, len(quantiles))
+		for i, value := range s[0].(percentileAccumulator).quantiles(quantiles) {
+			percentiles[names[i]] = float32(value)
+		}
+		return percentiles
+	}
+	a.store = func(ctx context.Context, r result) error {
+		pdt := domain.PercentileDeliveryTime{
+			Date:        r.date,
+			WindowStart: r.start,
+			Group:       r.group,
+			Percentiles: report(r.states[0]),
+		}
+		if len(r.states) > 1 {
+			pdt.Windows = make(map[string]domain.PercentileDeliveryTime, len(r.states))
+			for i, s := range r.states {
+				pdt.Windows[a.windowNames[i]] = domain.PercentileDeliveryTime{Percentiles: report(s)}
+			}
+		}
+		return output.add(ctx, pdt)
+	}
+	a.seedWindow()
+	return a
 }
 
-type slidingWindow struct {
-	windowSize int
-	buckets    map[time.Time]state
-	state      state
+func newApplication(cfg Config) *Application {
+	bucket := cfg.Bucket
+	if bucket <= 0 {
+		bucket = time.Minute
+	}
 
-	start time.Time
-	head  time.Time
-	tail  time.Time
+	windowType := cfg.WindowType
+	if windowType == "" {
+		windowType = WindowTypeSliding
+	}
+
+	windowSizes := cfg.WindowSizes
+	if len(windowSizes) == 0 {
+		windowSizes = []int{cfg.WindowSize}
+	}
+	windowNames := make([]string, len(windowSizes))
+	for i, size := range windowSizes {
+		windowNames[i] = durationName(time.Duration(size) * bucket)
+	}
+
+	// the hop is how often a window's aggregation is stored
+	var hop time.Duration
+	switch windowType {
+	case WindowTypeTumbling:
+		hop = time.Duration(windowSizes[0]) * bucket
+	case WindowTypeHopping:
+		hop = cfg.Hop
+	}
+	if hop <= 0 {
+		hop = bucket
+	}
+
+	return &Application{
+		rejectedStorer:  cfg.RejectedStorer,
+		stateStorer:     cfg.StateStorer,
+		inputMode:       cfg.InputMode,
+		windowType:      windowType,
+		windowSizes:     windowSizes,
+		windowNames:     windowNames,
+		bucket:          bucket,
+		hop:             hop,
+		sessionGap:      cfg.SessionGap,
+		groupBy:         cfg.GroupBy,
+		allowedLateness: cfg.AllowedLateness,
+		skipEmpty:       cfg.SkipEmpty,
+		from:            cfg.From,
+		to:              cfg.To,
+		windows:         map[string]window{},
+	}
 }
 
-// ProcessEvent calculates the moving average for all time-buckets since the last event. If this is the first event
-// it initializes the time-buckets. The moving-average is calculated based on the windowSize provided in the Init method
-func (a *Application) ProcessEvent(event domain.TranslationDelivered) error {
-	bucket := event.Timestamp.Truncate(time.Minute).Add(time.Minute)
+// ProcessEvent adds the event to the window of its group, which stores the aggregations that are complete afterwards.
+// With the default sliding window, the moving aggregation is calculated for all time-buckets up to the watermark of the
+// event's group. The watermark is the latest event timestamp of the group minus the allowed lateness, which means that
+// aggregations are only emitted when no more events are expected for them. Events that arrive after their aggregation
+// was emitted are too late: they're not aggregated, but stored as rejected events instead. Events outside the range
+// of the Application, if any, are dropped and only counted.
+func (a *Application) ProcessEvent(ctx context.Context, event domain.TranslationDelivered) error {
+	if !a.inRange(event) {
+		a.summary.OutOfRangeEvents++
+		return nil
+	}
 
-	sw := a.sw
-	// we must initialize the values when the first event is processed
-	if sw.start.IsZero() {
-		start := bucket.Add(-time.Minute)
-		sw.start = start
-		sw.head = start
-		sw.tail = start
+	accepted, err := a.window(event).process(ctx, event)
+	if err != nil {
+		return err
+	}
+	if !accepted {
+		return a.reject(ctx, event, domain.RejectionReasonLate)
 	}
 
-	// We must iterate X times until we get to the current event time bucket
-	for beforeOrEqual(sw.head, bucket) {
+	a.summary.ProcessedEvents++
+	return nil
+}
 
-		sw.buckets[sw.head] = state{}
+// ProcessEvents processes the events in order, like ProcessEvent, but stores the aggregations of all the time-buckets
+// advanced by the batch at once, with StoreMovingAverageSlice (or StorePercentilesSlice). This allows storers to write
+// in bulk. If an event can't be processed, the aggregations of the previous ones are still stored.
+func (a *Application) ProcessEvents(ctx context.Context, events []domain.TranslationDelivered) error {
+	return processBatch(ctx, a.batch, events, a.ProcessEvent)
+}
 
-		// when we are at the time bucket of the current event, we add it to the state
-		if sw.head.Equal(bucket) {
-			sw.state.count += 1
-			sw.state.duration += event.Duration
-			sw.buckets[sw.head] = state{
-				duration: event.Duration,
-				count:    1,
-			}
+// AdvanceTo stores the aggregations of every window that are complete at the provided time, even if no events arrived
+// for them. This allows windows to keep advancing when the stream is idle (e.g., driven by the wall-clock). Events that
+// arrive afterwards for those aggregations are too late.
+func (a *Application) AdvanceTo(ctx context.Context, t time.Time) error {
+	// windows are advanced in a deterministic order, so that the output doesn't change between runs
+	for _, key := range sortedKeys(a.windows) {
+		if err := a.windows[key].advance(ctx, t); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// when we exceed the current window size, we must remove the last item and advance the tail
-		if len(sw.buckets) > sw.windowSize {
-			sw.state.count -= sw.buckets[sw.tail].count
-			sw.state.duration -= sw.buckets[sw.tail].duration
+// Flush stores the aggregations of every window until the time-bucket of its latest event, without waiting for the
+// allowed lateness. The events waiting for late events are aggregated first.
+func (a *Application) Flush(ctx context.Context) error {
+	for _, key := range sortedKeys(a.windows) {
+		if err := a.windows[key].flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			delete(sw.buckets, sw.tail)
-			sw.tail = sw.tail.Add(time.Minute)
+// Finish stores the aggregations of every window until it's empty, i.e., until its last event leaves it. The events
+// waiting for late events are aggregated first.
+func (a *Application) Finish(ctx context.Context) error {
+	for _, key := range sortedKeys(a.windows) {
+		if err := a.windows[key].finish(ctx); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// inRange returns true if the event is in [from, to), ignoring the limits that are zero
+func (a *Application) inRange(event domain.TranslationDelivered) bool {
+	if !a.from.IsZero() && event.Timestamp.Before(a.from) {
+		return false
+	}
+	return a.to.IsZero() || event.Timestamp.Before(a.to)
+}
+
+// reject counts the event as rejected and stores it, if there is a storer for rejected events
+func (a *Application) reject(ctx context.Context, event domain.TranslationDelivered, reason string) error {
+	if reason == domain.RejectionReasonLate {
+		a.summary.LateEvents++
+	}
+
+	if a.rejectedStorer == nil {
+		return nil
+	}
+	return a.rejectedStorer.StoreRejectedEvent(ctx, domain.RejectedEvent{
+		Reason: reason,
+		Event:  event,
+	})
+}
+
+// Summary returns the counts of events processed so far
+func (a *Application) Summary() domain.ProcessingSummary {
+	return a.summary
+}
+
+// checkpoint is the JSON representation of the state of an Application
+type checkpoint struct {
+	// InputMode identifies what the Offset counts, since it can't be resumed from an input read in another mode
+	InputMode string `json:"input_mode"`
+	Offset    int64  `json:"offset"`
+	// Config is part of the checkpoint since the state of the windows can't be restored with a different one
+	Config  windowConfig               `json:"config"`
+	Windows map[string]json.RawMessage `json:"windows"`
+	Summary domain.ProcessingSummary   `json:"summary"`
+}
+
+// windowConfig is the configuration that determines the state kept by the windows
+type windowConfig struct {
+	WindowType string `json:"window_type"`
+	WindowSize int    `json:"window_size"`
+	// WindowSizes is only set when there are several window sizes
+	WindowSizes string        `json:"window_sizes,omitempty"`
+	Bucket      time.Duration `json:"bucket"`
+	Hop         time.Duration `json:"hop"`
+	SessionGap  time.Duration `json:"session_gap"`
+	// Metrics and Weighted determine the accumulators of each state
+	Metrics  string `json:"metrics"`
+	Weighted bool   `json:"weighted"`
+	// RelativeAccuracy determines the bins of the percentile histograms, which are exact durations if it's 0
+	RelativeAccuracy float64 `json:"relative_accuracy,omitempty"`
+	// GroupBy determines the keys of the windows, and AllowedLateness the events they keep pending
+	GroupBy         string        `json:"group_by"`
+	AllowedLateness time.Duration `json:"allowed_lateness"`
+}
+
+func (a *Application) windowConfig() windowConfig {
+	// the lists are kept as text, so that the configuration can be compared
+	var windowSizes string
+	if len(a.windowSizes) > 1 {
+		windowSizes = fmt.Sprint(a.windowSizes)
+	}
+	return windowConfig{
+		WindowType:       a.windowType,
+		WindowSize:       a.windowSizes[0],
+		WindowSizes:      windowSizes,
+		Bucket:           a.bucket,
+		Hop:              a.hop,
+		SessionGap:       a.sessionGap,
+		Metrics:          strings.Join(a.metrics, ","),
+		Weighted:         a.weighted,
+		RelativeAccuracy: a.relativeAccuracy,
+		GroupBy:          strings.Join(a.groupBy, ","),
+		AllowedLateness:  a.allowedLateness,
+	}
+}
+
+// Checkpoint stores the state of all the windows, along with the offset of the input, with the StateStorer, so that it
+// can be restored after a restart. It does nothing if there is no StateStorer.
+func (a *Application) Checkpoint(ctx context.Context, offset int64) error {
+	return checkpointWith(ctx, a, a.stateStorer, offset)
+}
 
-		// once we're done, we calculate the average for the current position
-		average := float32(0)
-		if sw.state.count != 0 {
-			// let's not divide by 0 ;)
-			average = float32(sw.state.duration) / float32(sw.state.count)
+// Restore replaces the state of all the windows with the last checkpoint stored with the StateStorer, and returns the
+// offset of the input stored along with it. It does nothing if there is no StateStorer or no checkpoint.
+func (a *Application) Restore(ctx context.Context) (int64, error) {
+	return restoreWith(ctx, a, a.stateStorer)
+}
+
+func (a *Application) snapshot(offset int64) ([]byte, error) {
+	c := checkpoint{
+		InputMode: a.inputMode,
+		Offset:    offset,
+		Config:    a.windowConfig(),
+		Windows:   make(map[string]json.RawMessage, len(a.windows)),
+		Summary:   a.summary,
+	}
+	for key, w := range a.windows {
+		data, err := json.Marshal(w)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode window: %w", err)
 		}
+		c.Windows[key] = data
+	}
+	return json.Marshal(c)
+}
 
-		adt := domain.AverageDeliveryTime{
-			Date:                domain.Time{Time: sw.head},
-			AverageDeliveryTime: average,
+func (a *Application) restoreSnapshot(data []byte) (int64, error) {
+	var c checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return 0, fmt.Errorf("could not decode checkpoint: %w", err)
+	}
+	if c.InputMode != a.inputMode {
+		return 0, inputModeError(c.InputMode, a.inputMode)
+	}
+	if c.Config != a.windowConfig() {
+		return 0, errors.New("the checkpoint was created with a different window configuration")
+	}
+
+	restored := make(map[string]window, len(c.Windows))
+	for key, data := range c.Windows {
+		w := a.newWindow(nil)
+		if err := json.Unmarshal(data, w); err != nil {
+			return 0, fmt.Errorf("could not decode window: %w", err)
 		}
+		restored[key] = w
+	}
 
-		err := a.storer.StoreMovingAverage(adt)
-		if err != nil {
-			return err
+	a.windows = restored
+	a.summary = c.Summary
+	return c.Offset, nil
+}
+
+// seedWindow creates the window of the events up front when the Application starts at a given time and they're not
+// grouped, so that its output covers the whole range even if there are no events in it. Grouped windows are only
+// created with their first event, since their groups aren't known before.
+func (a *Application) seedWindow() {
+	if a.from.IsZero() || len(a.groupBy) > 0 || a.windowType == WindowTypeSession {
+		return
+	}
+	key, group := groupOf(domain.TranslationDelivered{}, a.groupBy)
+	a.windows[key] = a.newWindow(group)
+}
+
+// window returns the window of the group the event belongs to, creating it if needed
+func (a *Application) window(event domain.TranslationDelivered) window {
+	key, group := groupOf(event, a.groupBy)
+
+	w, ok := a.windows[key]
+	if !ok {
+		w = a.newWindow(group)
+		a.windows[key] = w
+	}
+	return w
+}
+
+// newWindow creates the window of a group according to the window type
+func (a *Application) newWindow(group map[string]string) window {
+	if a.windowType == WindowTypeSession {
+		return &sessionWindow{
+			gap:             a.sessionGap,
+			allowedLateness: a.allowedLateness,
+			store:           a.store,
+			group:           group,
+			accumulators:    a.accumulators,
 		}
+	}
 
-		// at the end we must advance the head to keep going
-		sw.head = sw.head.Add(time.Minute)
+	sw := &slidingWindow{
+		windowSizes:     a.windowSizes,
+		bucket:          a.bucket,
+		hop:             a.hop,
+		allowedLateness: a.allowedLateness,
+		skipEmpty:       a.skipEmpty,
+		store:           a.store,
+		buckets:         map[time.Time]state{},
+		pending:         map[time.Time]state{},
+		group:           group,
+		accumulators:    a.accumulators,
 	}
-	return nil
+	if !a.from.IsZero() {
+		sw.seed(a.from)
+	}
+	return sw
+}
+
+// groupOf returns the key and the dimension values of the group the event belongs to. The group is nil if there is
+// no grouping.
+func groupOf(event domain.TranslationDelivered, groupBy []string) (string, map[string]string) {
+	var group map[string]string
+	if len(groupBy) > 0 {
+		group = make(map[string]string, len(groupBy))
+	}
+	values := make([]string, 0, len(groupBy))
+	for _, dimension := range groupBy {
+		value, _ := event.Dimension(dimension)
+		group[dimension] = value
+		values = append(values, value)
+	}
+	// the null character is used as separator since it's very unlikely to be part of a dimension value
+	return strings.Join(values, "\x00"), group
 }
 
-func beforeOrEqual(a, b time.Time) bool {
-	return a.Before(b) || a.Equal(b)
+// durationName returns the duration without its trailing zero units (e.g., 15m instead of 15m0s)
+func durationName(d time.Duration) string {
+	name := d.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = strings.TrimSuffix(name, "0s")
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = strings.TrimSuffix(name, "0m")
+	}
+	return name
+}
+
+// sortedKeys returns the keys of the map in a deterministic order
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
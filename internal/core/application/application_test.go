@@ -1,9 +1,14 @@
 package application
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/lucaslobo/aggregator/internal/core/domain"
 	"github.com/stretchr/testify/assert"
@@ -13,19 +18,32 @@ import (
 type mockStorer struct {
 	t     *testing.T
 	store []domain.AverageDeliveryTime
+	// slices counts the calls to StoreMovingAverageSlice
+	slices int
+	// stored is called after each record is stored, if set
+	stored func()
+	// err is returned instead of storing the records, if set
+	err error
 }
 
-func (ms *mockStorer) StoreMovingAverage(deliveryTime domain.AverageDeliveryTime) error {
+func (ms *mockStorer) StoreMovingAverage(_ context.Context, deliveryTime domain.AverageDeliveryTime) error {
+	if ms.err != nil {
+		return ms.err
+	}
 	if ms.store == nil {
 		ms.store = make([]domain.AverageDeliveryTime, 0)
 	}
 	ms.store = append(ms.store, deliveryTime)
+	if ms.stored != nil {
+		ms.stored()
+	}
 	return nil
 }
 
-func (ms *mockStorer) StoreMovingAverageSlice(deliveryTimes []domain.AverageDeliveryTime) error {
+func (ms *mockStorer) StoreMovingAverageSlice(ctx context.Context, deliveryTimes []domain.AverageDeliveryTime) error {
+	ms.slices++
 	for _, deliveryItem := range deliveryTimes {
-		err := ms.StoreMovingAverage(deliveryItem)
+		err := ms.StoreMovingAverage(ctx, deliveryItem)
 		if err != nil {
 			return err
 		}
@@ -37,6 +55,55 @@ func (ms *mockStorer) Close() error {
 	return nil
 }
 
+type mockPercentileStorer struct {
+	store []domain.PercentileDeliveryTime
+}
+
+func (ms *mockPercentileStorer) StorePercentiles(_ context.Context, percentiles domain.PercentileDeliveryTime) error {
+	ms.store = append(ms.store, percentiles)
+	return nil
+}
+
+func (ms *mockPercentileStorer) StorePercentilesSlice(_ context.Context, percentiles []domain.PercentileDeliveryTime) error {
+	ms.store = append(ms.store, percentiles...)
+	return nil
+}
+
+func (ms *mockPercentileStorer) Close() error {
+	return nil
+}
+
+type mockRejectedStorer struct {
+	store []domain.RejectedEvent
+	// err is returned instead of storing the rejected events, if set
+	err error
+}
+
+func (ms *mockRejectedStorer) StoreRejectedEvent(_ context.Context, rejected domain.RejectedEvent) error {
+	if ms.err != nil {
+		return ms.err
+	}
+	ms.store = append(ms.store, rejected)
+	return nil
+}
+
+func (ms *mockRejectedStorer) Close() error {
+	return nil
+}
+
+type mockStateStorer struct {
+	state []byte
+}
+
+func (ms *mockStateStorer) StoreState(_ context.Context, state []byte) error {
+	ms.state = state
+	return nil
+}
+
+func (ms *mockStateStorer) LoadState(context.Context) ([]byte, error) {
+	return ms.state, nil
+}
+
 func TestProcessEvents_WindowSize(t *testing.T) {
 
 	tests := []struct {
@@ -61,15 +128,16 @@ func TestProcessEvents_WindowSize(t *testing.T) {
 			ms := mockStorer{
 				t: t,
 			}
-			a := New(tc.windowSize, &ms)
+			a := New(Config{WindowSize: tc.windowSize}, &ms)
 
 			events := createEvents(t, 3)
 			results := createResultsWindow(t, tc.windowSize)
 
 			for _, event := range events {
-				err := a.ProcessEvent(event)
+				err := a.ProcessEvent(t.Context(), event)
 				require.NoError(t, err)
 			}
+			require.NoError(t, a.Flush(t.Context()))
 
 			assert.Equal(t, results, ms.store)
 		})
@@ -80,19 +148,1226 @@ func TestProcessEvents_OneEvent(t *testing.T) {
 	ms := mockStorer{
 		t: t,
 	}
-	a := New(10, &ms)
+	a := New(Config{WindowSize: 10}, &ms)
 
 	events := createEvents(t, 1)
 	results := createResultsWindow(t, 10)[0:2]
 
 	for _, event := range events {
-		err := a.ProcessEvent(event)
+		err := a.ProcessEvent(t.Context(), event)
 		require.NoError(t, err)
 	}
+	require.NoError(t, a.Flush(t.Context()))
 
 	assert.Equal(t, results, ms.store)
 }
 
+func TestProcessEvents_GroupBy(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	a := New(Config{WindowSize: 10, GroupBy: []string{domain.DimensionClientName}}, &ms)
+
+	events := []domain.TranslationDelivered{
+		{
+			Timestamp:  mustGetTime(t, "2018-12-26 18:11:08.509654"),
+			ClientName: "airliberty",
+			Duration:   20,
+		},
+		{
+			Timestamp:  mustGetTime(t, "2018-12-26 18:12:19.903159"),
+			ClientName: "taxi-eats",
+			Duration:   54,
+		},
+		{
+			Timestamp:  mustGetTime(t, "2018-12-26 18:13:19.903159"),
+			ClientName: "airliberty",
+			Duration:   31,
+		},
+	}
+
+	for _, event := range events {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, a.Flush(t.Context()))
+
+	airliberty := map[string]string{domain.DimensionClientName: "airliberty"}
+	taxiEats := map[string]string{domain.DimensionClientName: "taxi-eats"}
+	results := []domain.AverageDeliveryTime{
+		{Date: mustGetTime(t, "2018-12-26 18:11:00.0000"), Group: airliberty, AverageDeliveryTime: 0},
+		{Date: mustGetTime(t, "2018-12-26 18:12:00.0000"), Group: taxiEats, AverageDeliveryTime: 0},
+		{Date: mustGetTime(t, "2018-12-26 18:12:00.0000"), Group: airliberty, AverageDeliveryTime: 20},
+		{Date: mustGetTime(t, "2018-12-26 18:13:00.0000"), Group: airliberty, AverageDeliveryTime: 20},
+		// the time-buckets of the last events are flushed in the order of the groups
+		{Date: mustGetTime(t, "2018-12-26 18:14:00.0000"), Group: airliberty, AverageDeliveryTime: 25.5},
+		{Date: mustGetTime(t, "2018-12-26 18:13:00.0000"), Group: taxiEats, AverageDeliveryTime: 54},
+	}
+
+	assert.Equal(t, results, ms.store)
+}
+
+func TestProcessEvents_Percentiles(t *testing.T) {
+	ms := mockPercentileStorer{}
+	a := NewPercentile(Config{WindowSize: 10, Percentiles: []float64{50, 99}}, &ms)
+
+	for _, event := range createEvents(t, 3) {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, a.Flush(t.Context()))
+
+	require.Len(t, ms.store, 14)
+	assert.Equal(t, mustGetTime(t, "2018-12-26 18:11:00.0000"), ms.store[0].Date)
+	assert.Equal(t, map[string]float32{"p50": 0, "p99": 0}, ms.store[0].Percentiles)
+	assert.Equal(t, map[string]float32{"p50": 20, "p99": 20}, ms.store[1].Percentiles)
+	assert.Equal(t, map[string]float32{"p50": 20, "p99": 31}, ms.store[5].Percentiles)
+	// the event of 18:12 has left the window
+	assert.Equal(t, map[string]float32{"p50": 31, "p99": 31}, ms.store[11].Percentiles)
+	assert.Equal(t, mustGetTime(t, "2018-12-26 18:24:00.0000"), ms.store[13].Date)
+	assert.Equal(t, map[string]float32{"p50": 31, "p99": 54}, ms.store[13].Percentiles)
+}
+
+func TestProcessEvents_Metrics(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	a := New(Config{
+		WindowSize: 10,
+		Metrics:    []string{MetricMin, MetricMax, MetricSum, MetricCount, MetricWords},
+	}, &ms)
+	// the average, the sum and the count share the same accumulator
+	assert.Len(t, a.accumulators, 4)
+
+	events := createEvents(t, 3)
+	for i := range events {
+		events[i].NrWords = 10 * (i + 1)
+	}
+	for _, event := range events {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, a.Flush(t.Context()))
+
+	ptr := func(v int) *int { return &v }
+	require.Len(t, ms.store, 14)
+	assert.Equal(t, domain.AverageDeliveryTime{
+		Date: mustGetTime(t, "2018-12-26 18:11:00.0000"),
+		// the min and max of an empty window are omitted
+		TotalDeliveryTime: ptr(0),
+		Count:             ptr(0),
+		TotalWords:        ptr(0),
+	}, ms.store[0])
+	assert.Equal(t, domain.AverageDeliveryTime{
+		Date:                mustGetTime(t, "2018-12-26 18:16:00.0000"),
+		AverageDeliveryTime: 25.5,
+		MinDeliveryTime:     ptr(20),
+		MaxDeliveryTime:     ptr(31),
+		TotalDeliveryTime:   ptr(51),
+		Count:               ptr(2),
+		TotalWords:          ptr(30),
+	}, ms.store[5])
+	// the event of 18:12 has left the window, so the min must be recalculated
+	assert.Equal(t, domain.AverageDeliveryTime{
+		Date:                mustGetTime(t, "2018-12-26 18:24:00.0000"),
+		AverageDeliveryTime: 42.5,
+		MinDeliveryTime:     ptr(31),
+		MaxDeliveryTime:     ptr(54),
+		TotalDeliveryTime:   ptr(85),
+		Count:               ptr(2),
+		TotalWords:          ptr(50),
+	}, ms.store[13])
+}
+
+func TestProcessEvents_Weighted(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	a := New(Config{WindowSize: 10, Weighted: true, Metrics: []string{MetricSecondsPerWord}}, &ms)
+
+	events := createEvents(t, 2)
+	events[0].NrWords = 10
+	events[1].NrWords = 30
+	for _, event := range events {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, a.Flush(t.Context()))
+
+	require.Len(t, ms.store, 6)
+	assert.Equal(t, float32(20), ms.store[1].AverageDeliveryTime)
+	assert.Equal(t, float32(2), *ms.store[1].SecondsPerWord)
+	// (20*10 + 31*30) / (10 + 30)
+	assert.Equal(t, float32(28.25), ms.store[5].AverageDeliveryTime)
+	// (20 + 31) / (10 + 30)
+	assert.Equal(t, float32(1.275), *ms.store[5].SecondsPerWord)
+}
+
+func TestProcessEvents_LateEventRejected(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	rs := mockRejectedStorer{}
+	a := New(Config{WindowSize: 10, RejectedStorer: &rs}, &ms)
+
+	events := createEvents(t, 3)
+	// the second event arrives after the third one, whose time-bucket is after the second's
+	for _, event := range []domain.TranslationDelivered{events[0], events[2], events[1]} {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, a.Flush(t.Context()))
+
+	require.Len(t, ms.store, 14)
+	// the event of 18:12 has left the window and the late one was not aggregated
+	assert.Equal(t, float32(54), ms.store[13].AverageDeliveryTime)
+	assert.Equal(t, []domain.RejectedEvent{{Reason: domain.RejectionReasonLate, Event: events[1]}}, rs.store)
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 2, LateEvents: 1}, a.Summary())
+}
+
+func TestProcessEvents_AllowedLateness(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	rs := mockRejectedStorer{}
+	a := New(Config{WindowSize: 10, AllowedLateness: 10 * time.Minute, RejectedStorer: &rs}, &ms)
+
+	events := createEvents(t, 3)
+	for _, event := range []domain.TranslationDelivered{events[1], events[0], events[2]} {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+
+	// time-buckets are only emitted once they end 10 minutes before the most recent event (18:23), so the window starts
+	// 10 minutes before the first event (18:15) and stops at 18:13
+	var results []domain.AverageDeliveryTime
+	start := mustGetTime(t, "2018-12-26 18:05:00.0000")
+	for i := 0; i < 6; i++ {
+		results = append(results, domain.AverageDeliveryTime{Date: domain.Time{Time: start.Add(time.Duration(i) * time.Minute)}})
+	}
+	results = append(results, createResultsWindowSize10(t)[:3]...)
+
+	assert.Equal(t, results, ms.store)
+	assert.Empty(t, rs.store)
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 3}, a.Summary())
+}
+
+func TestAdvanceTo(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	rs := mockRejectedStorer{}
+	a := New(Config{WindowSize: 10, RejectedStorer: &rs}, &ms)
+
+	events := createEvents(t, 3)
+	err := a.ProcessEvent(t.Context(), events[0])
+	require.NoError(t, err)
+
+	// the stream is idle, but time-buckets keep being emitted up to the provided time
+	err = a.AdvanceTo(t.Context(), mustGetTime(t, "2018-12-26 18:14:30.0000").Time)
+	require.NoError(t, err)
+	assert.Equal(t, createResultsWindowSize10(t)[:4], ms.store)
+
+	// events keep being aggregated as usual, and their time-bucket is emitted once it's over...
+	err = a.ProcessEvent(t.Context(), events[1])
+	require.NoError(t, err)
+	assert.Equal(t, createResultsWindowSize10(t)[:5], ms.store)
+
+	// ...except if their time-bucket was already emitted
+	err = a.AdvanceTo(t.Context(), mustGetTime(t, "2018-12-26 18:24:00.0000").Time)
+	require.NoError(t, err)
+	err = a.ProcessEvent(t.Context(), events[2])
+	require.NoError(t, err)
+	require.Len(t, ms.store, 14)
+	assert.Equal(t, createResultsWindowSize10(t)[:13], ms.store[:13])
+	assert.Equal(t, float32(31), ms.store[13].AverageDeliveryTime)
+	assert.Len(t, rs.store, 1)
+}
+
+func TestAdvanceTo_Cancelled(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	a := New(Config{WindowSize: 10}, &ms)
+
+	events := createEvents(t, 1)
+	err := a.ProcessEvent(t.Context(), events[0])
+	require.NoError(t, err)
+
+	// the ctx is cancelled while the idle time-buckets are being emitted
+	ctx, cancel := context.WithCancel(t.Context())
+	ms.stored = func() {
+		if len(ms.store) == 3 {
+			cancel()
+		}
+	}
+	err = a.AdvanceTo(ctx, mustGetTime(t, "2018-12-26 18:14:30.0000").Time)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, createResultsWindowSize10(t)[:3], ms.store)
+
+	// the state is still valid, so the remaining time-buckets are emitted once advanced again
+	ms.stored = nil
+	err = a.AdvanceTo(t.Context(), mustGetTime(t, "2018-12-26 18:14:30.0000").Time)
+	require.NoError(t, err)
+	assert.Equal(t, createResultsWindowSize10(t)[:4], ms.store)
+}
+
+func TestProcessEvents_Bucket(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	// 1 minute window with 30 seconds time-buckets
+	a := New(Config{WindowSize: 2, Bucket: 30 * time.Second}, &ms)
+
+	for _, event := range createEvents(t, 2) {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, a.Flush(t.Context()))
+
+	averages := []float32{0, 20, 20, 0, 0, 0, 0, 0, 0, 31}
+	require.Len(t, ms.store, len(averages))
+	start := mustGetTime(t, "2018-12-26 18:11:00.0000")
+	for i, average := range averages {
+		assert.Equal(t, start.Add(time.Duration(i)*30*time.Second), ms.store[i].Date.Time)
+		assert.Equal(t, average, ms.store[i].AverageDeliveryTime)
+	}
+
+	// the output has a precision of seconds
+	bytes, err := json.Marshal(ms.store[1].Date)
+	require.NoError(t, err)
+	assert.Equal(t, `"2018-12-26 18:11:30"`, string(bytes))
+}
+
+func TestProcessEvents_SkipEmpty(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	a := New(Config{WindowSize: 1, SkipEmpty: true}, &ms)
+
+	for _, event := range createEvents(t, 3) {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, a.Flush(t.Context()))
+
+	// only the first of consecutive empty time-buckets is stored
+	results := createResultsWindowSize1(t)
+	assert.Equal(t, []domain.AverageDeliveryTime{results[0], results[1], results[2], results[5], results[6], results[13]}, ms.store)
+}
+
+func TestProcessEvents_LargeGap(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	a := New(Config{WindowSize: 10, SkipEmpty: true}, &ms)
+
+	events := createEvents(t, 2)
+	// the second event arrives one year later
+	events[1].Timestamp = domain.Time{Time: events[1].Timestamp.AddDate(1, 0, 0)}
+	for _, event := range events {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, a.Flush(t.Context()))
+
+	// the first event is in the window until 18:21, then the window is empty until the second event
+	require.Len(t, ms.store, 13)
+	assert.Equal(t, createResultsWindowSize10(t)[:5], ms.store[:5])
+	assert.Equal(t, domain.AverageDeliveryTime{Date: mustGetTime(t, "2018-12-26 18:21:00.0000"), AverageDeliveryTime: 20}, ms.store[10])
+	assert.Equal(t, domain.AverageDeliveryTime{Date: mustGetTime(t, "2018-12-26 18:22:00.0000")}, ms.store[11])
+	assert.Equal(t, domain.AverageDeliveryTime{Date: mustGetTime(t, "2019-12-26 18:16:00.0000"), AverageDeliveryTime: 31}, ms.store[12])
+}
+
+func TestProcessEvents_WindowType(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		dates    []string
+		averages []float32
+	}{
+		{
+			name:     "tumbling",
+			cfg:      Config{WindowType: WindowTypeTumbling, WindowSize: 5},
+			dates:    []string{"2018-12-26 18:15:00.0000", "2018-12-26 18:20:00.0000"},
+			averages: []float32{20, 31},
+		},
+		{
+			name:     "hopping",
+			cfg:      Config{WindowType: WindowTypeHopping, WindowSize: 10, Hop: 5 * time.Minute},
+			dates:    []string{"2018-12-26 18:15:00.0000", "2018-12-26 18:20:00.0000"},
+			averages: []float32{20, 25.5},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ms := mockStorer{
+				t: t,
+			}
+			a := New(tc.cfg, &ms)
+
+			for _, event := range createEvents(t, 3) {
+				err := a.ProcessEvent(t.Context(), event)
+				require.NoError(t, err)
+			}
+
+			require.Len(t, ms.store, len(tc.dates))
+			for i, date := range tc.dates {
+				assert.Equal(t, mustGetTime(t, date).Time, ms.store[i].Date.Time)
+				assert.Equal(t, tc.averages[i], ms.store[i].AverageDeliveryTime)
+				assert.Nil(t, ms.store[i].WindowStart)
+			}
+		})
+	}
+}
+
+func TestProcessEvents_WindowSizes(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	ss := mockStateStorer{}
+	cfg := Config{WindowSizes: []int{10, 1, 20}, Metrics: []string{MetricCount}, StateStorer: &ss}
+	a := New(cfg, &ms)
+
+	// the windows are checkpointed in the middle, which must not change their output
+	events := createEvents(t, 3)
+	for _, event := range events[:2] {
+		require.NoError(t, a.ProcessEvent(t.Context(), event))
+	}
+	require.NoError(t, a.Checkpoint(t.Context(), 0))
+	a = New(cfg, &ms)
+	_, err := a.Restore(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, a.ProcessEvent(t.Context(), events[2]))
+	require.NoError(t, a.Flush(t.Context()))
+
+	// each window size has the same aggregations as when it's the only one
+	expected := map[string][]domain.AverageDeliveryTime{
+		"10m": createResultsWindowSize10(t),
+		"1m":  createResultsWindowSize1(t),
+		"20m": createResultsWindowSize20(t),
+	}
+	require.Len(t, ms.store, len(expected["10m"]))
+	for i, adt := range ms.store {
+		// the record's own aggregation is the one of the first window size
+		assert.Equal(t, expected["10m"][i].Date, adt.Date)
+		assert.Equal(t, expected["10m"][i].AverageDeliveryTime, adt.AverageDeliveryTime)
+
+		require.Len(t, adt.Windows, len(expected))
+		for name, results := range expected {
+			assert.Equal(t, results[i].AverageDeliveryTime, adt.Windows[name].AverageDeliveryTime, "%s at %s", name, adt.Date)
+			assert.True(t, adt.Windows[name].Date.IsZero())
+		}
+	}
+	assert.Equal(t, 3, *ms.store[len(ms.store)-1].Windows["20m"].Count)
+	assert.Equal(t, 2, *ms.store[len(ms.store)-1].Windows["10m"].Count)
+	assert.Equal(t, 1, *ms.store[len(ms.store)-1].Windows["1m"].Count)
+}
+
+func TestProcessEvents_WindowSizesStoreError(t *testing.T) {
+	cfg := Config{WindowSizes: []int{2, 5}, Metrics: []string{MetricCount}}
+	events := createEvents(t, 2)
+	expected := mockStorer{t: t}
+	reference := New(cfg, &expected)
+	ms := mockStorer{t: t}
+	a := New(cfg, &ms)
+	for _, c := range []*Application{reference, a} {
+		require.NoError(t, c.ProcessEvent(t.Context(), events[0]))
+		require.NoError(t, c.AdvanceTo(t.Context(), mustGetTime(t, "2018-12-26 18:13:00.000000").Time))
+	}
+
+	// the first event leaves the 2m window at the next time-bucket, which can't be stored. The head stays there, and
+	// advancing again stores it without evicting the event a second time.
+	ms.err = errors.New("disk full")
+	require.Error(t, a.AdvanceTo(t.Context(), events[1].Timestamp.Time))
+	require.Error(t, a.AdvanceTo(t.Context(), events[1].Timestamp.Time))
+	ms.err = nil
+
+	for _, c := range []*Application{reference, a} {
+		require.NoError(t, c.ProcessEvent(t.Context(), events[1]))
+		require.NoError(t, c.Flush(t.Context()))
+	}
+	assert.Equal(t, expected.store, ms.store)
+	for _, adt := range ms.store {
+		assert.GreaterOrEqual(t, *adt.Windows["2m"].Count, 0, "2m at %s", adt.Date)
+	}
+}
+
+func TestProcessEvents_Batch(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	rs := mockRejectedStorer{}
+	cfg := Config{WindowSize: 10, DedupWindow: time.Hour, RejectedStorer: &rs}
+	filter, err := NewFilter(cfg, "duration != 99", NewDeduplicator(cfg, New(cfg, &ms)))
+	require.NoError(t, err)
+
+	events := createEvents(t, 3)
+	for i := range events {
+		events[i].TranslationId = fmt.Sprintf("translation-%d", i)
+	}
+	filtered := events[1]
+	filtered.TranslationId = "filtered"
+	filtered.Duration = 99
+
+	// the duplicate and the filtered events don't reach the Application, which stores the output of each batch at once
+	require.NoError(t, filter.ProcessEvents(t.Context(), []domain.TranslationDelivered{events[0], filtered, events[1]}))
+	require.NoError(t, filter.ProcessEvents(t.Context(), []domain.TranslationDelivered{events[0], events[2]}))
+	assert.Equal(t, 2, ms.slices)
+	assert.Equal(t, createResultsWindowSize10(t)[:13], ms.store)
+	assert.Len(t, rs.store, 1)
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 3, DuplicateEvents: 1, FilteredEvents: 1}, filter.Summary())
+
+	// the output is stored one at a time outside of batches
+	require.NoError(t, filter.Flush(t.Context()))
+	assert.Equal(t, createResultsWindowSize10(t), ms.store)
+	require.NoError(t, filter.AdvanceTo(t.Context(), mustGetTime(t, "2018-12-26 18:26:00.0000").Time))
+	assert.Equal(t, 2, ms.slices)
+	assert.Len(t, ms.store, len(createResultsWindowSize10(t))+2)
+}
+
+func TestProcessEvents_SessionWindow(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	rs := mockRejectedStorer{}
+	a := New(Config{WindowType: WindowTypeSession, SessionGap: 5 * time.Minute, RejectedStorer: &rs}, &ms)
+
+	events := createEvents(t, 3)
+	for _, event := range events {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+
+	// the first two events are less than 5 minutes apart, so the session ends 5 minutes after the second one
+	require.Len(t, ms.store, 1)
+	assert.Equal(t, events[0].Timestamp.Time, ms.store[0].WindowStart.Time)
+	assert.Equal(t, events[1].Timestamp.Add(5*time.Minute), ms.store[0].Date.Time)
+	assert.Equal(t, float32(25.5), ms.store[0].AverageDeliveryTime)
+
+	// events of a session that already ended are too late
+	err := a.ProcessEvent(t.Context(), events[1])
+	require.NoError(t, err)
+	assert.Len(t, rs.store, 1)
+
+	// the last session ends once its gap has passed
+	err = a.AdvanceTo(t.Context(), mustGetTime(t, "2018-12-26 18:30:00.0000").Time)
+	require.NoError(t, err)
+	require.Len(t, ms.store, 2)
+	assert.Equal(t, events[2].Timestamp.Time, ms.store[1].WindowStart.Time)
+	assert.Equal(t, float32(54), ms.store[1].AverageDeliveryTime)
+
+	bytes, err := json.Marshal(ms.store[1])
+	require.NoError(t, err)
+	assert.Equal(t, `{"date":"2018-12-26 18:28:19","window_start":"2018-12-26 18:23:19","average_delivery_time":54}`, string(bytes))
+}
+
+func TestFinish(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	rs := mockRejectedStorer{}
+	a := New(Config{WindowSize: 10, RejectedStorer: &rs}, &ms)
+
+	events := createEvents(t, 3)
+	for _, event := range events {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, a.Flush(t.Context()))
+	require.Equal(t, createResultsWindowSize10(t), ms.store)
+
+	// the window keeps advancing until the last event leaves it
+	err := a.Finish(t.Context())
+	require.NoError(t, err)
+	averages := []float32{42.5, 54, 54, 54, 54, 54, 54, 54, 54}
+	require.Len(t, ms.store, len(createResultsWindowSize10(t))+len(averages))
+	for i, average := range averages {
+		stored := ms.store[len(createResultsWindowSize10(t))+i]
+		assert.Equal(t, mustGetTime(t, "2018-12-26 18:25:00.0000").Add(time.Duration(i)*time.Minute), stored.Date.Time)
+		assert.Equal(t, average, stored.AverageDeliveryTime)
+	}
+
+	// finishing again doesn't store anything, and the events of the finished time-buckets are too late
+	err = a.Finish(t.Context())
+	require.NoError(t, err)
+	err = a.ProcessEvent(t.Context(), events[2])
+	require.NoError(t, err)
+	assert.Len(t, ms.store, len(createResultsWindowSize10(t))+len(averages))
+	assert.Len(t, rs.store, 1)
+
+	// the current session is stored as if its gap had passed
+	ms = mockStorer{
+		t: t,
+	}
+	a = New(Config{WindowType: WindowTypeSession, SessionGap: 5 * time.Minute, AllowedLateness: time.Minute}, &ms)
+	for _, event := range events {
+		err = a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	require.Len(t, ms.store, 1)
+	err = a.Finish(t.Context())
+	require.NoError(t, err)
+	require.Len(t, ms.store, 2)
+	assert.Equal(t, events[2].Timestamp.Add(5*time.Minute), ms.store[1].Date.Time)
+	assert.Equal(t, float32(54), ms.store[1].AverageDeliveryTime)
+}
+
+func TestProcessEvents_Range(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	from := mustGetTime(t, "2018-12-26 18:05:00.0000").Time
+	to := mustGetTime(t, "2018-12-26 18:20:00.0000").Time
+	a := New(Config{WindowSize: 10, From: from, To: to}, &ms)
+
+	// the last event is after the range, so it's dropped
+	for _, event := range createEvents(t, 3) {
+		err := a.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 2, OutOfRangeEvents: 1}, a.Summary())
+
+	// the output starts right after the beginning of the range, and is padded until its end
+	err := a.AdvanceTo(t.Context(), to)
+	require.NoError(t, err)
+	require.Len(t, ms.store, 15)
+	for i, stored := range ms.store {
+		assert.Equal(t, from.Add(time.Duration(i+1)*time.Minute), stored.Date.Time)
+	}
+	assert.Equal(t, float32(0), ms.store[0].AverageDeliveryTime)
+	assert.Equal(t, float32(25.5), ms.store[14].AverageDeliveryTime)
+
+	// events before the range are dropped as well
+	err = a.ProcessEvent(t.Context(), domain.TranslationDelivered{Timestamp: domain.Time{Time: from.Add(-time.Second)}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, a.Summary().OutOfRangeEvents)
+}
+
+func TestProcessEvents_RangeWithoutEvents(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	from := mustGetTime(t, "2018-12-26 18:30:00.0000").Time
+	to := mustGetTime(t, "2018-12-26 18:35:00.0000").Time
+	a := New(Config{WindowSize: 10, From: from, To: to}, &ms)
+
+	// all the events are before the range, which is padded with empty time-buckets anyway
+	for _, event := range createEvents(t, 3) {
+		require.NoError(t, a.ProcessEvent(t.Context(), event))
+	}
+	require.NoError(t, a.Flush(t.Context()))
+	require.NoError(t, a.AdvanceTo(t.Context(), to))
+	require.Len(t, ms.store, 5)
+	for i, stored := range ms.store {
+		assert.Equal(t, domain.AverageDeliveryTime{Date: domain.Time{Time: from.Add(time.Duration(i+1) * time.Minute)}}, stored)
+	}
+	assert.Equal(t, domain.ProcessingSummary{OutOfRangeEvents: 3}, a.Summary())
+}
+
+func TestProcessEvents_RangeWiderThanEvents(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	from := mustGetTime(t, "2018-12-26 18:00:00.0000").Time
+	to := mustGetTime(t, "2018-12-26 18:40:00.0000").Time
+	a := New(Config{WindowSize: 10, From: from, To: to}, &ms)
+
+	for _, event := range createEvents(t, 3) {
+		require.NoError(t, a.ProcessEvent(t.Context(), event))
+	}
+	require.NoError(t, a.AdvanceTo(t.Context(), to))
+
+	// the output is padded before the first event and after the last one leaves the window
+	require.Len(t, ms.store, 40)
+	for i, stored := range ms.store {
+		assert.Equal(t, from.Add(time.Duration(i+1)*time.Minute), stored.Date.Time)
+	}
+	for _, stored := range ms.store[:10] {
+		assert.Equal(t, float32(0), stored.AverageDeliveryTime)
+	}
+	assert.Equal(t, createResultsWindowSize10(t), ms.store[10:24])
+	assert.Equal(t, float32(54), ms.store[31].AverageDeliveryTime)
+	for _, stored := range ms.store[33:] {
+		assert.Equal(t, float32(0), stored.AverageDeliveryTime)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	configs := map[string]Config{
+		"sliding":  {WindowSize: 10, AllowedLateness: time.Minute, Metrics: []string{MetricMin, MetricCount, MetricSecondsPerWord}},
+		"weighted": {WindowSize: 5, Weighted: true, SkipEmpty: true},
+		"session":  {WindowType: WindowTypeSession, SessionGap: 5 * time.Minute, Metrics: []string{MetricMax}},
+	}
+
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			events := createEvents(t, 3)
+			until := mustGetTime(t, "2018-12-26 18:40:00.0000").Time
+
+			// the reference processes all the events without interruption
+			expected := mockStorer{t: t}
+			reference := New(cfg, &expected)
+			for _, event := range events {
+				require.NoError(t, reference.ProcessEvent(t.Context(), event))
+			}
+			require.NoError(t, reference.AdvanceTo(t.Context(), until))
+
+			// the state is checkpointed after the first two events, and restored in a new Application
+			ss := mockStateStorer{}
+			cfg.StateStorer = &ss
+			ms := mockStorer{t: t}
+			a := New(cfg, &ms)
+			offset, err := a.Restore(t.Context())
+			require.NoError(t, err)
+			assert.Equal(t, int64(0), offset)
+			for _, event := range events[:2] {
+				require.NoError(t, a.ProcessEvent(t.Context(), event))
+			}
+			require.NoError(t, a.Checkpoint(t.Context(), 2))
+
+			restored := New(cfg, &ms)
+			offset, err = restored.Restore(t.Context())
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), offset)
+			require.NoError(t, restored.ProcessEvent(t.Context(), events[2]))
+			require.NoError(t, restored.AdvanceTo(t.Context(), until))
+
+			assert.Equal(t, expected.store, ms.store)
+			assert.Equal(t, reference.Summary(), restored.Summary())
+		})
+	}
+}
+
+func TestCheckpoint_Config(t *testing.T) {
+	base := Config{
+		WindowSize:      10,
+		Metrics:         []string{MetricMin, MetricCount},
+		GroupBy:         []string{domain.DimensionClientName},
+		AllowedLateness: time.Minute,
+	}
+
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+	}{
+		{name: "window size", change: func(cfg *Config) { cfg.WindowSize = 5 }},
+		// the metrics have the same number of accumulators, but different ones
+		{name: "metrics", change: func(cfg *Config) { cfg.Metrics = []string{MetricMax, MetricCount} }},
+		{name: "metrics order", change: func(cfg *Config) { cfg.Metrics = []string{MetricCount, MetricMin} }},
+		{name: "weighted", change: func(cfg *Config) { cfg.Weighted = true }},
+		{name: "group by", change: func(cfg *Config) { cfg.GroupBy = []string{domain.DimensionSourceLanguage} }},
+		{name: "allowed lateness", change: func(cfg *Config) { cfg.AllowedLateness = 0 }},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := mockStateStorer{}
+			cfg := base
+			cfg.StateStorer = &ss
+			a := New(cfg, &mockStorer{t: t})
+			require.NoError(t, a.ProcessEvent(t.Context(), createEvents(t, 1)[0]))
+			require.NoError(t, a.Checkpoint(t.Context(), 1))
+
+			// the checkpoint is restored with the same configuration...
+			_, err := New(cfg, &mockStorer{t: t}).Restore(t.Context())
+			require.NoError(t, err)
+
+			// ...but not with a different one
+			tc.change(&cfg)
+			_, err = New(cfg, &mockStorer{t: t}).Restore(t.Context())
+			assert.ErrorContains(t, err, "different window configuration")
+		})
+	}
+}
+
+func TestCheckpoint_InputMode(t *testing.T) {
+	tests := []struct {
+		name string
+		new  func(cfg Config) Calculator
+	}{
+		{name: "moving average", new: func(cfg Config) Calculator { return New(cfg, &mockStorer{t: t}) }},
+		{name: "exponential moving average", new: func(cfg Config) Calculator {
+			return NewExponentialMovingAverage(cfg, time.Minute, &mockStorer{t: t})
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ss := mockStateStorer{}
+			cfg := Config{WindowSize: 10, StateStorer: &ss, InputMode: "merge"}
+			c := tc.new(cfg)
+			require.NoError(t, c.ProcessEvent(t.Context(), createEvents(t, 1)[0]))
+			require.NoError(t, c.Checkpoint(t.Context(), 1))
+
+			// the offset counts merged events, so it's restored when merging again...
+			offset, err := tc.new(cfg).Restore(t.Context())
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), offset)
+
+			// ...but not as a byte offset when reading the files one after the other
+			cfg.InputMode = "files"
+			_, err = tc.new(cfg).Restore(t.Context())
+			assert.ErrorContains(t, err, `created with the "merge" input mode`)
+		})
+	}
+}
+
+func TestCheckpoint_Percentiles(t *testing.T) {
+	ss := mockStateStorer{}
+	cfg := Config{WindowSize: 10, Percentiles: []float64{50, 90}, RelativeAccuracy: 0.01, StateStorer: &ss}
+	events := createEvents(t, 3)
+
+	expected := mockPercentileStorer{}
+	reference := NewPercentile(cfg, &expected)
+	ps := mockPercentileStorer{}
+	a := NewPercentile(cfg, &ps)
+	for i, event := range events {
+		require.NoError(t, reference.ProcessEvent(t.Context(), event))
+		if i == 2 {
+			a = NewPercentile(cfg, &ps)
+			_, err := a.Restore(t.Context())
+			require.NoError(t, err)
+		}
+		require.NoError(t, a.ProcessEvent(t.Context(), event))
+		require.NoError(t, a.Checkpoint(t.Context(), int64(i)))
+	}
+	assert.Equal(t, expected.store, ps.store)
+
+	// the checkpoint can't be restored with a different configuration, including the binning of the histograms
+	for _, change := range []func(cfg *Config){
+		func(cfg *Config) { cfg.WindowSize = 5 },
+		func(cfg *Config) { cfg.RelativeAccuracy = 0 },
+		func(cfg *Config) { cfg.RelativeAccuracy = 0.05 },
+	} {
+		changed := cfg
+		change(&changed)
+		_, err := NewPercentile(changed, &ps).Restore(t.Context())
+		assert.ErrorContains(t, err, "different window configuration")
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	rs := mockRejectedStorer{}
+	ss := mockStateStorer{}
+	cfg := Config{WindowSize: 10, DedupWindow: 10 * time.Minute, RejectedStorer: &rs, StateStorer: &ss}
+	d := NewDeduplicator(cfg, New(cfg, &ms))
+
+	events := createEvents(t, 3)
+	for i := range events {
+		events[i].TranslationId = fmt.Sprintf("translation-%d", i)
+	}
+	// the first event is emitted again with the timestamp of the second one...
+	retried := events[0]
+	retried.Timestamp = events[1].Timestamp
+	// ...and later, once it has left the dedup window
+	expired := events[0]
+	expired.Timestamp = events[2].Timestamp
+
+	for _, event := range []domain.TranslationDelivered{events[0], events[1], retried} {
+		require.NoError(t, d.ProcessEvent(t.Context(), event))
+	}
+	require.Len(t, rs.store, 1)
+	assert.Equal(t, domain.RejectedEvent{Reason: domain.RejectionReasonDuplicate, Event: retried}, rs.store[0])
+
+	// the seen-set is checkpointed along with the state of the Application
+	require.NoError(t, d.Checkpoint(t.Context(), 0))
+	d = NewDeduplicator(cfg, New(cfg, &ms))
+	_, err := d.Restore(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, d.ProcessEvent(t.Context(), retried))
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 2, DuplicateEvents: 2}, d.Summary())
+
+	// the expired event is not a duplicate anymore, so it's aggregated along with the event of the same time-bucket
+	for _, event := range []domain.TranslationDelivered{events[2], expired} {
+		require.NoError(t, d.ProcessEvent(t.Context(), event))
+	}
+	require.NoError(t, d.Flush(t.Context()))
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 4, DuplicateEvents: 2}, d.Summary())
+	require.Len(t, ms.store, 14)
+	assert.Equal(t, createResultsWindowSize10(t)[:13], ms.store[:13])
+	// (31 + 54 + 20) / 3
+	assert.Equal(t, float32(35), ms.store[13].AverageDeliveryTime)
+}
+
+func TestDeduplicator_RejectedStoreError(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	rs := mockRejectedStorer{err: errors.New("disk full")}
+	cfg := Config{WindowSize: 10, DedupWindow: 10 * time.Minute, RejectedStorer: &rs}
+	d := NewDeduplicator(cfg, New(cfg, &ms))
+
+	events := createEvents(t, 3)
+	for i := range events {
+		events[i].TranslationId = fmt.Sprintf("translation-%d", i)
+	}
+	batch := []domain.TranslationDelivered{events[0], events[1], events[0], events[2]}
+
+	// the duplicate can't be stored, but the events before it are aggregated, since their ids are already seen
+	require.Error(t, d.ProcessEvents(t.Context(), batch))
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 2, DuplicateEvents: 1}, d.Summary())
+
+	// once the batch is processed again, only the event after the duplicate is new
+	rs.err = nil
+	require.NoError(t, d.ProcessEvents(t.Context(), batch))
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 3, DuplicateEvents: 4}, d.Summary())
+}
+
+func TestFilter(t *testing.T) {
+	event := domain.TranslationDelivered{
+		TranslationId:  "5aa5b2f39f7254a75aa5",
+		SourceLanguage: "en",
+		TargetLanguage: "fr",
+		ClientName:     "airliberty",
+		EventName:      "translation_delivered",
+		NrWords:        30,
+		Duration:       20,
+	}
+
+	tests := []struct {
+		expression string
+		matches    bool
+	}{
+		{`client_name == "airliberty"`, true},
+		{`client_name != "airliberty"`, false},
+		{`client_name == "airliberty" && nr_words > 50`, false},
+		{`client_name == "airliberty" || nr_words > 50`, true},
+		{`!(nr_words > 50)`, true},
+		{`nr_words >= 30 && duration <= 20 && duration < 20.5`, true},
+		{`50 < nr_words`, false},
+		{`(source_language == "en" || source_language == "de") && target_language == "fr"`, true},
+		{`source_language < "fr"`, true},
+		{`client_name == "air\"liberty"`, false},
+		// && binds tighter than ||
+		{`duration == 1 && nr_words == 30 || event_name == "translation_delivered"`, true},
+		{`!duration == 20 || translation_id == "5aa5b2f39f7254a75aa5"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			matches, err := parseFilter(tt.expression)
+			require.NoError(t, err)
+			assert.Equal(t, tt.matches, matches(event))
+		})
+	}
+
+	for _, expression := range []string{
+		``,
+		`client_name`,
+		`client_name == `,
+		`client == "airliberty"`,
+		`client_name == 50`,
+		`client_name = "airliberty"`,
+		`(nr_words > 50`,
+		`nr_words > 50)`,
+		`nr_words > 5.0.1`,
+		`client_name == "airliberty`,
+		`nr_words > 50 &&`,
+	} {
+		_, err := NewFilter(Config{}, expression, New(Config{WindowSize: 10}, &mockStorer{t: t}))
+		assert.Error(t, err, expression)
+	}
+}
+
+func TestFilter_Checkpoint(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	ss := mockStateStorer{}
+	cfg := Config{WindowSize: 10, StateStorer: &ss}
+	f, err := NewFilter(cfg, "duration != 99", New(cfg, &ms))
+	require.NoError(t, err)
+
+	events := createEvents(t, 3)
+	filtered := events[1]
+	filtered.Duration = 99
+	for _, event := range []domain.TranslationDelivered{events[0], events[1], filtered} {
+		require.NoError(t, f.ProcessEvent(t.Context(), event))
+	}
+
+	// the count of filtered events is checkpointed along with the state of the Application
+	require.NoError(t, f.Checkpoint(t.Context(), 0))
+	f, err = NewFilter(cfg, "duration != 99", New(cfg, &ms))
+	require.NoError(t, err)
+	_, err = f.Restore(t.Context())
+	require.NoError(t, err)
+
+	require.NoError(t, f.ProcessEvent(t.Context(), events[2]))
+	require.NoError(t, f.Flush(t.Context()))
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 3, FilteredEvents: 1}, f.Summary())
+	assert.Equal(t, createResultsWindowSize10(t), ms.store)
+}
+
+func TestRouter(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	rs := mockRejectedStorer{}
+	ss := mockStateStorer{}
+	cfg := Config{WindowSize: 10, RejectedStorer: &rs, StateStorer: &ss}
+	r := NewRouter(cfg, New(cfg, &ms))
+
+	lines := []string{
+		`{"timestamp": "2018-12-26 18:11:08.509654","translation_id": "5aa5b2f39f7254a75aa5","event_name": "translation_delivered","nr_words": 30, "duration": 20}`,
+		`{"timestamp": "2018-12-26 18:12:00.000000","translation_id": "5aa5b2f39f7254a75aa4","event_name": "translation_requested","nr_words": 30}`,
+		`{"timestamp": "2018-12-26 18:13:00.000000","translation_id": "5aa5b2f39f7254a75aa5","event_name": "translation_cancelled"}`,
+		`{"timestamp": "2018-12-26 18:14:00.000000","event_name": "translation_archived"}`,
+		`{"timestamp": "2018-12-26 18:14:30.000000","duration": 99}`,
+		`{"timestamp": "2018-12-26 18:15:19.903159","translation_id": "5aa5b2f39f7254a75aa4","event_name": "translation_delivered","nr_words": 30, "duration": 31}`,
+	}
+	envelopes := make([]domain.Envelope, len(lines))
+	for i, line := range lines {
+		require.NoError(t, json.Unmarshal([]byte(line), &envelopes[i]))
+		require.NoError(t, r.Route(t.Context(), envelopes[i]))
+	}
+
+	// the unknown events are rejected as they were read
+	require.Len(t, rs.store, 2)
+	for i, envelope := range envelopes[3:5] {
+		assert.Equal(t, domain.RejectionReasonUnknownEvent, rs.store[i].Reason)
+		data, err := json.Marshal(rs.store[i].Event)
+		require.NoError(t, err)
+		assert.JSONEq(t, lines[3+i], string(data))
+		assert.Equal(t, envelope, rs.store[i].Event)
+	}
+
+	// the counts are checkpointed along with the state of the Application
+	require.NoError(t, r.Checkpoint(t.Context(), 0))
+	r = NewRouter(cfg, New(cfg, &ms))
+	_, err := r.Restore(t.Context())
+	require.NoError(t, err)
+
+	// handlers can be registered for the other types of events
+	var cancelled []domain.TranslationCancelled
+	r.Register(domain.EventNameTranslationCancelled, func(_ context.Context, event any) error {
+		cancelled = append(cancelled, event.(domain.TranslationCancelled))
+		return nil
+	})
+	require.NoError(t, r.Route(t.Context(), envelopes[2]))
+	require.Len(t, cancelled, 1)
+	assert.Equal(t, "5aa5b2f39f7254a75aa5", cancelled[0].TranslationId)
+
+	require.NoError(t, r.ProcessEvent(t.Context(), createEvents(t, 3)[2]))
+	require.NoError(t, r.Flush(t.Context()))
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 3, UnknownEvents: 2, IgnoredEvents: 2}, r.Summary())
+	assert.Equal(t, createResultsWindowSize10(t), ms.store)
+}
+
+func TestRouter_RouteEvents(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	rs := mockRejectedStorer{}
+	cfg := Config{WindowSize: 10, RejectedStorer: &rs}
+	r := NewRouter(cfg, New(cfg, &ms))
+
+	lines := []string{
+		`{"timestamp": "2018-12-26 18:11:08.509654","event_name": "translation_delivered","duration": 20}`,
+		`{"timestamp": "2018-12-26 18:15:19.903159","event_name": "translation_delivered","duration": 31}`,
+		`{"timestamp": "2018-12-26 18:16:00.000000","event_name": "translation_archived"}`,
+		`{"timestamp": "2018-12-26 18:23:19.903159","event_name": "translation_delivered","duration": 54}`,
+	}
+	envelopes := make([]domain.Envelope, len(lines))
+	for i, line := range lines {
+		require.NoError(t, json.Unmarshal([]byte(line), &envelopes[i]))
+	}
+
+	// the delivered events before and after the unknown one are processed in two batches, in order
+	require.NoError(t, r.RouteEvents(t.Context(), envelopes))
+	assert.Equal(t, 2, ms.slices)
+	require.NoError(t, r.Flush(t.Context()))
+	assert.Equal(t, createResultsWindowSize10(t), ms.store)
+	require.Len(t, rs.store, 1)
+	assert.Equal(t, envelopes[2], rs.store[0].Event)
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 3, UnknownEvents: 1}, r.Summary())
+
+	// the delivered events are dispatched one at a time to the handler registered for them
+	var delivered []domain.TranslationDelivered
+	r.Register(domain.EventNameTranslationDelivered, func(_ context.Context, event any) error {
+		delivered = append(delivered, event.(domain.TranslationDelivered))
+		return nil
+	})
+	require.NoError(t, r.RouteEvents(t.Context(), envelopes))
+	assert.Len(t, delivered, 3)
+	assert.Equal(t, 2, ms.slices)
+}
+
+func TestConcurrent(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	ss := mockStateStorer{}
+	cfg := Config{WindowSize: 10, StateStorer: &ss}
+	c := NewConcurrent(NewRouter(cfg, New(cfg, &ms)))
+
+	// all the events have the same timestamp, and the windows are advanced before it, so the output doesn't depend on
+	// the order they're processed in
+	event := createEvents(t, 1)[0]
+	before := event.Timestamp.Add(-time.Minute)
+	var unknown domain.Envelope
+	require.NoError(t, json.Unmarshal([]byte(`{"timestamp": "2018-12-26 18:11:08.509654","event_name": "translation_archived"}`), &unknown))
+
+	// several producers use the Concurrent at the same time, which is checked with the race detector
+	const producers, events = 8, 50
+	var wg sync.WaitGroup
+	for range producers {
+		wg.Go(func() {
+			for range events {
+				assert.NoError(t, c.ProcessEvent(t.Context(), event))
+				assert.NoError(t, c.ProcessEvents(t.Context(), []domain.TranslationDelivered{event, event}))
+				assert.NoError(t, c.Route(t.Context(), unknown))
+			}
+		})
+	}
+	wg.Go(func() {
+		for range events {
+			assert.NoError(t, c.AdvanceTo(t.Context(), before))
+			assert.NoError(t, c.Checkpoint(t.Context(), 0))
+			assert.LessOrEqual(t, c.Summary().ProcessedEvents, producers*events*3)
+		}
+	})
+	wg.Wait()
+
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: producers * events * 3, UnknownEvents: producers * events}, c.Summary())
+	require.NoError(t, c.AdvanceTo(t.Context(), mustGetTime(t, "2018-12-26 18:14:30.0000").Time))
+
+	// the last checkpoint includes the events of all the calls that returned before it
+	require.NoError(t, c.Checkpoint(t.Context(), 0))
+	r := NewRouter(cfg, New(cfg, &mockStorer{t: t}))
+	_, err := r.Restore(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, c.Summary(), r.Summary())
+
+	require.NoError(t, c.Close())
+
+	// the output is the same as processing the events one at a time
+	expected := mockStorer{
+		t: t,
+	}
+	a := New(Config{WindowSize: 10}, &expected)
+	require.NoError(t, a.AdvanceTo(t.Context(), before))
+	for range producers * events * 3 {
+		require.NoError(t, a.ProcessEvent(t.Context(), event))
+	}
+	require.NoError(t, a.AdvanceTo(t.Context(), mustGetTime(t, "2018-12-26 18:14:30.0000").Time))
+	assert.Equal(t, expected.store, ms.store)
+}
+
+func TestExponentialMovingAverage(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	events := createEvents(t, 2)
+	// the half-life is the time between both events, so the first one weighs half as much as the second one
+	halfLife := events[1].Timestamp.Sub(events[0].Timestamp.Time)
+	e := NewExponentialMovingAverage(Config{}, halfLife, &ms)
+
+	for _, event := range events {
+		err := e.ProcessEvent(t.Context(), event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, e.Flush(t.Context()))
+
+	averages := []float32{0, 20, 20, 20, 20, (0.5*20 + 31) / 1.5}
+	require.Len(t, ms.store, len(averages))
+	for i, average := range averages {
+		assert.Equal(t, mustGetTime(t, "2018-12-26 18:11:00.0000").Add(time.Duration(i)*time.Minute), ms.store[i].Date.Time)
+		assert.InDelta(t, average, ms.store[i].AverageDeliveryTime, 0.001)
+	}
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 2}, e.Summary())
+
+	// the averages are restored from a checkpoint
+	ss := mockStateStorer{}
+	e.stateStorer = &ss
+	require.NoError(t, e.Checkpoint(t.Context(), 0))
+	restored := NewExponentialMovingAverage(Config{StateStorer: &ss}, halfLife, &ms)
+	_, err := restored.Restore(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, e.averages, restored.averages)
+	assert.Equal(t, e.Summary(), restored.Summary())
+
+	// the keys of the averages depend on the groups, so they can't be restored with different ones
+	grouped := NewExponentialMovingAverage(Config{GroupBy: []string{domain.DimensionClientName}, StateStorer: &ss}, halfLife, &ms)
+	_, err = grouped.Restore(t.Context())
+	assert.ErrorContains(t, err, "different half-life, bucket or group by")
+}
+
+func TestExponentialMovingAverage_SameBucket(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	e := NewExponentialMovingAverage(Config{}, 20*time.Second, &ms)
+
+	// the second event is after the first one and the third one is between both, all in the same time-bucket
+	events := []domain.TranslationDelivered{
+		{Timestamp: mustGetTime(t, "2018-12-26 18:11:10.0000"), Duration: 20},
+		{Timestamp: mustGetTime(t, "2018-12-26 18:11:30.0000"), Duration: 40},
+		{Timestamp: mustGetTime(t, "2018-12-26 18:11:20.0000"), Duration: 30},
+	}
+	for _, event := range events {
+		require.NoError(t, e.ProcessEvent(t.Context(), event))
+	}
+	// the time-bucket of the events is only stored once no more events are expected for it
+	require.Len(t, ms.store, 1)
+	require.NoError(t, e.Flush(t.Context()))
+
+	// the weights are relative to the most recent event: 0.5 for the first one and 2^-0.5 for the third one
+	weight := math.Exp2(-0.5)
+	average := (0.5*20 + 40 + weight*30) / (0.5 + 1 + weight)
+	require.Len(t, ms.store, 2)
+	assert.Equal(t, mustGetTime(t, "2018-12-26 18:12:00.0000"), ms.store[1].Date)
+	assert.InDelta(t, average, ms.store[1].AverageDeliveryTime, 0.001)
+	assert.Equal(t, domain.ProcessingSummary{ProcessedEvents: 3}, e.Summary())
+}
+
+func TestExponentialMovingAverage_FinishGroups(t *testing.T) {
+	ms := mockStorer{
+		t: t,
+	}
+	e := NewExponentialMovingAverage(Config{GroupBy: []string{domain.DimensionClientName}}, time.Minute, &ms)
+	events := []domain.TranslationDelivered{
+		{Timestamp: mustGetTime(t, "2018-12-26 18:11:10.0000"), ClientName: "a", Duration: 20},
+		{Timestamp: mustGetTime(t, "2018-12-26 18:15:30.0000"), ClientName: "b", Duration: 40},
+	}
+	for _, event := range events {
+		require.NoError(t, e.ProcessEvent(t.Context(), event))
+	}
+	require.NoError(t, e.Flush(t.Context()))
+	require.NoError(t, e.Finish(t.Context()))
+
+	// every group ends at the time-bucket of the latest event, even the ones whose events are older
+	last := map[string]domain.Time{}
+	for _, adt := range ms.store {
+		last[adt.Group[domain.DimensionClientName]] = adt.Date
+	}
+	expected := mustGetTime(t, "2018-12-26 18:16:00.0000")
+	assert.Equal(t, map[string]domain.Time{"a": expected, "b": expected}, last)
+}
+
+func TestHistogram_RelativeAccuracy(t *testing.T) {
+	relativeAccuracy := 0.01
+	h := newHistogram(newLogBinning(relativeAccuracy))
+	other := newHistogram(newLogBinning(relativeAccuracy))
+	for duration := 1; duration <= 10000; duration++ {
+		h.add(duration)
+		other.add(duration)
+	}
+
+	quantiles := []float64{0.5, 0.9, 0.99}
+	expected := []float64{5000, 9000, 9900}
+	for i, value := range h.quantiles(quantiles) {
+		assert.InEpsilon(t, expected[i], value, relativeAccuracy)
+	}
+
+	// removing the events must leave the histogram empty
+	h.subtract(other)
+	assert.Equal(t, []float64{0, 0, 0}, h.quantiles(quantiles))
+}
+
 func mustGetTime(t *testing.T, val string) domain.Time {
 	var tt domain.Time
 	err := json.Unmarshal([]byte("\""+val+"\""), &tt)
@@ -0,0 +1,61 @@
+package application
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+)
+
+// batcher buffers the output stored while a batch of events is processed
+type batcher interface {
+	// start buffers the output until the next flush
+	start()
+	// flush stores the buffered output at once, and stops buffering
+	flush(ctx context.Context) error
+}
+
+// outputBatch stores the output records one at a time, except during a batch, when they're buffered and stored at once
+// with storeSlice (e.g., a bulk insert).
+type outputBatch[T any] struct {
+	store      func(ctx context.Context, record T) error
+	storeSlice func(ctx context.Context, records []T) error
+
+	active  bool
+	records []T
+}
+
+func (b *outputBatch[T]) add(ctx context.Context, record T) error {
+	if !b.active {
+		return b.store(ctx, record)
+	}
+	b.records = append(b.records, record)
+	return nil
+}
+
+func (b *outputBatch[T]) start() {
+	b.active = true
+}
+
+func (b *outputBatch[T]) flush(ctx context.Context) error {
+	b.active = false
+	if len(b.records) == 0 {
+		return nil
+	}
+
+	records := b.records
+	b.records = nil
+	return b.storeSlice(ctx, records)
+}
+
+// processBatch processes the events one at a time, buffering their output with the batcher to store it at once at the
+// end. If an event fails, the output of the previous ones is still stored, since they're already part of the state.
+func processBatch(ctx context.Context, b batcher, events []domain.TranslationDelivered, process func(ctx context.Context, event domain.TranslationDelivered) error) error {
+	b.start()
+	for _, event := range events {
+		if err := process(ctx, event); err != nil {
+			return errors.Join(err, b.flush(ctx))
+		}
+	}
+	return b.flush(ctx)
+}
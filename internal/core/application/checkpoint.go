@@ -0,0 +1,51 @@
+package application
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lucaslobo/aggregator/internal/core/inboundprt"
+	"github.com/lucaslobo/aggregator/internal/core/outboundprt"
+)
+
+// Calculator is a MovingAverageCalculator implemented by this package. Its state can be encoded, so that the decorators
+// that wrap it (e.g., the Deduplicator) can checkpoint their own state along with it, atomically.
+type Calculator interface {
+	inboundprt.MovingAverageCalculator
+
+	// snapshot encodes the state, along with the offset of the input
+	snapshot(offset int64) ([]byte, error)
+	// restoreSnapshot replaces the state with an encoded one, returning its offset
+	restoreSnapshot(data []byte) (int64, error)
+}
+
+// checkpointWith stores the snapshot of the calculator with the storer. It does nothing if there is no storer.
+func checkpointWith(ctx context.Context, c Calculator, storer outboundprt.StateStorer, offset int64) error {
+	if storer == nil {
+		return nil
+	}
+	data, err := c.snapshot(offset)
+	if err != nil {
+		return err
+	}
+	return storer.StoreState(ctx, data)
+}
+
+// restoreWith restores the calculator from the last snapshot stored with the storer, and returns its offset. It does
+// nothing if there is no storer or no snapshot.
+func restoreWith(ctx context.Context, c Calculator, storer outboundprt.StateStorer) (int64, error) {
+	if storer == nil {
+		return 0, nil
+	}
+	data, err := storer.LoadState(ctx)
+	if err != nil || data == nil {
+		return 0, err
+	}
+	return c.restoreSnapshot(data)
+}
+
+// inputModeError is returned when restoring a checkpoint whose offset counts something else than the current input mode
+// does, e.g., bytes of the input files instead of the events merged from them
+func inputModeError(checkpointed, current string) error {
+	return fmt.Errorf("the checkpoint was created with the %q input mode, and can't be restored with the %q one", checkpointed, current)
+}
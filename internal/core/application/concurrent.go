@@ -0,0 +1,132 @@
+package application
+
+import (
+	"context"
+	"time"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+	"github.com/lucaslobo/aggregator/internal/core/inboundprt"
+)
+
+// Concurrent makes an EventRouter safe for concurrent use, e.g., by several queue pollers. The wrapped EventRouter is
+// owned by a single goroutine, which runs the calls one at a time, in the order they arrive. This way, neither the
+// Application nor its decorators need any synchronization, and each call sees the state left by the previous one.
+//
+// The events of concurrent calls are processed in any order, so the ones that are late because of it are handled as
+// usual (e.g., accepted within the allowed lateness, or rejected).
+type Concurrent struct {
+	svc inboundprt.EventRouter
+
+	calls chan func()
+	done  chan struct{}
+}
+
+// NewConcurrent creates a Concurrent that wraps svc, and starts the goroutine that owns it. svc must not be used
+// directly until the Concurrent is closed.
+func NewConcurrent(svc inboundprt.EventRouter) *Concurrent {
+	c := &Concurrent{
+		svc:   svc,
+		calls: make(chan func()),
+		done:  make(chan struct{}),
+	}
+	go c.own()
+	return c
+}
+
+func (c *Concurrent) own() {
+	defer close(c.done)
+	for call := range c.calls {
+		call()
+	}
+}
+
+// run runs the call in the goroutine that owns the svc, and waits for its result. It stops waiting for its turn if the
+// ctx is cancelled, but once running, the call is only interrupted by the ctx as the svc is.
+func (c *Concurrent) run(ctx context.Context, call func() error) error {
+	result := make(chan error, 1)
+	select {
+	case c.calls <- func() { result <- call() }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-result
+}
+
+func (c *Concurrent) Route(ctx context.Context, envelope domain.Envelope) error {
+	return c.run(ctx, func() error {
+		return c.svc.Route(ctx, envelope)
+	})
+}
+
+// RouteEvents routes the events as a single call, so the events of concurrent calls are never interleaved with them
+func (c *Concurrent) RouteEvents(ctx context.Context, envelopes []domain.Envelope) error {
+	return c.run(ctx, func() error {
+		return c.svc.RouteEvents(ctx, envelopes)
+	})
+}
+
+func (c *Concurrent) ProcessEvent(ctx context.Context, event domain.TranslationDelivered) error {
+	return c.run(ctx, func() error {
+		return c.svc.ProcessEvent(ctx, event)
+	})
+}
+
+// ProcessEvents processes the events as a single call, so the events of concurrent calls are never interleaved with
+// them
+func (c *Concurrent) ProcessEvents(ctx context.Context, events []domain.TranslationDelivered) error {
+	return c.run(ctx, func() error {
+		return c.svc.ProcessEvents(ctx, events)
+	})
+}
+
+func (c *Concurrent) AdvanceTo(ctx context.Context, t time.Time) error {
+	return c.run(ctx, func() error {
+		return c.svc.AdvanceTo(ctx, t)
+	})
+}
+
+func (c *Concurrent) Flush(ctx context.Context) error {
+	return c.run(ctx, func() error {
+		return c.svc.Flush(ctx)
+	})
+}
+
+func (c *Concurrent) Finish(ctx context.Context) error {
+	return c.run(ctx, func() error {
+		return c.svc.Finish(ctx)
+	})
+}
+
+func (c *Concurrent) Summary() domain.ProcessingSummary {
+	var summary domain.ProcessingSummary
+	_ = c.run(context.Background(), func() error {
+		summary = c.svc.Summary()
+		return nil
+	})
+	return summary
+}
+
+// Checkpoint stores the state of the svc, which includes the events of all the calls that returned before it
+func (c *Concurrent) Checkpoint(ctx context.Context, offset int64) error {
+	return c.run(ctx, func() error {
+		return c.svc.Checkpoint(ctx, offset)
+	})
+}
+
+func (c *Concurrent) Restore(ctx context.Context) (int64, error) {
+	var offset int64
+	err := c.run(ctx, func() error {
+		var err error
+		offset, err = c.svc.Restore(ctx)
+		return err
+	})
+	return offset, err
+}
+
+// Close stops the goroutine that owns the svc, once the calls in progress are done. The Concurrent must not be used
+// afterward, while the svc can be used directly again.
+func (c *Concurrent) Close() error {
+	close(c.calls)
+	<-c.done
+	return nil
+}
@@ -0,0 +1,58 @@
+package application
+
+import (
+	"time"
+
+	"github.com/lucaslobo/aggregator/internal/core/outboundprt"
+)
+
+// Config is used to provide configuration parameters to set up the Application
+type Config struct {
+	// WindowType is one of the AvailableWindowTypes. Defaults to WindowTypeSliding.
+	WindowType string
+	// WindowSize is the number of time-buckets in the moving window. It's not used by session windows.
+	WindowSize int
+	// WindowSizes holds several sizes of sliding or hopping windows that are aggregated at once, over the same events.
+	// Each output record has the aggregation of every size. If empty, WindowSize is the only size.
+	WindowSizes []int
+	// Bucket is the duration of each time-bucket (e.g., 10s, 1m, 1h). Defaults to 1 minute.
+	Bucket time.Duration
+	// Hop is how often the aggregation of a hopping window is stored. It must be a multiple of Bucket.
+	Hop time.Duration
+	// SessionGap is the time without events after which a session window ends
+	SessionGap time.Duration
+	// GroupBy is the list of event dimensions (e.g., client_name) used to split the events into groups. Each group
+	// keeps an independent window. If empty, all the events are aggregated together.
+	GroupBy []string
+	// AllowedLateness is how late (compared to the most recent event) an event can arrive and still be aggregated.
+	// Time-buckets are only emitted once the most recent event is AllowedLateness after them.
+	AllowedLateness time.Duration
+	// SkipEmpty makes the Application store only the first of consecutive time-buckets whose window has no events
+	SkipEmpty bool
+	// From and To, when not zero, limit the events aggregated to the ones in [From, To). The others are dropped and
+	// counted in the summary. Sliding, tumbling and hopping windows start at From, even if their first event is later.
+	// Without GroupBy, the window is created up front, so its output covers the range even if there are no events.
+	From time.Time
+	To   time.Time
+	// RejectedStorer stores the events that can't be aggregated, e.g., because they arrived too late (optional)
+	RejectedStorer outboundprt.RejectedEventStorer
+	// DedupWindow is how long (compared to the most recent event) the translation ids are kept by the Deduplicator to
+	// detect duplicate events
+	DedupWindow time.Duration
+	// StateStorer stores the checkpoints of the state, which are restored on startup (optional)
+	StateStorer outboundprt.StateStorer
+	// InputMode identifies what the offsets of the checkpoints count (e.g., bytes of the input files, or events merged
+	// from them). It's part of the checkpoints, which can't be restored with a different one.
+	InputMode string
+	// Metrics is the list of AvailableMetrics added to the moving average output, besides the average itself
+	Metrics []string
+	// Weighted makes the moving average weight the duration of each event by its number of words
+	Weighted bool
+
+	// Percentiles is the list of percentiles (0 < p <= 100) calculated by the percentile Application
+	Percentiles []float64
+	// RelativeAccuracy, when > 0, makes the percentile Application use a logarithmic sketch that guarantees the provided
+	// relative accuracy (e.g., 0.01 for 1%) instead of calculating exact percentiles. This bounds the memory used by
+	// large windows.
+	RelativeAccuracy float64
+}
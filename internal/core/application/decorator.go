@@ -0,0 +1,105 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+	"github.com/lucaslobo/aggregator/internal/core/outboundprt"
+)
+
+// decorator is embedded by the Calculators that wrap another one to handle the events before it (e.g., the
+// Deduplicator). It forwards all the methods to the wrapped Calculator, so that each decorator only overrides the ones
+// it changes. Its checkpoints hold the state of the decorator along with the state of the wrapped Calculator, so that
+// both are stored atomically with the StateStorer. The wrapped Calculator doesn't use its own.
+type decorator struct {
+	svc         Calculator
+	stateStorer outboundprt.StateStorer
+	// state encodes the fields of the decorator that are part of its checkpoints
+	state decoratorState
+}
+
+// decoratorState is the part of the state of a decorator that is checkpointed along with the wrapped Calculator. It's
+// encoded as JSON, and decoded into the decorator when a checkpoint is restored.
+type decoratorState interface {
+	json.Marshaler
+	json.Unmarshaler
+}
+
+func newDecorator(svc Calculator, stateStorer outboundprt.StateStorer, state decoratorState) decorator {
+	return decorator{svc: svc, stateStorer: stateStorer, state: state}
+}
+
+func (d *decorator) ProcessEvent(ctx context.Context, event domain.TranslationDelivered) error {
+	return d.svc.ProcessEvent(ctx, event)
+}
+
+func (d *decorator) ProcessEvents(ctx context.Context, events []domain.TranslationDelivered) error {
+	return d.svc.ProcessEvents(ctx, events)
+}
+
+func (d *decorator) AdvanceTo(ctx context.Context, t time.Time) error {
+	return d.svc.AdvanceTo(ctx, t)
+}
+
+func (d *decorator) Flush(ctx context.Context) error {
+	return d.svc.Flush(ctx)
+}
+
+func (d *decorator) Finish(ctx context.Context) error {
+	return d.svc.Finish(ctx)
+}
+
+func (d *decorator) Summary() domain.ProcessingSummary {
+	return d.svc.Summary()
+}
+
+// Checkpoint stores the state of the decorator and of the wrapped Calculator, along with the offset of the input, with
+// the StateStorer. It does nothing if there is no StateStorer.
+func (d *decorator) Checkpoint(ctx context.Context, offset int64) error {
+	return checkpointWith(ctx, d, d.stateStorer, offset)
+}
+
+// Restore replaces the state of the decorator and of the wrapped Calculator with the last checkpoint stored with the
+// StateStorer, and returns the offset of the input stored along with it. It does nothing if there is no StateStorer or
+// no checkpoint.
+func (d *decorator) Restore(ctx context.Context) (int64, error) {
+	return restoreWith(ctx, d, d.stateStorer)
+}
+
+// decoratorCheckpoint is the JSON representation of the state of a decorator
+type decoratorCheckpoint struct {
+	Decorator json.RawMessage `json:"decorator"`
+	// State is the snapshot of the wrapped Calculator
+	State json.RawMessage `json:"state"`
+}
+
+func (d *decorator) snapshot(offset int64) ([]byte, error) {
+	state, err := d.svc.snapshot(offset)
+	if err != nil {
+		return nil, err
+	}
+	decorator, err := d.state.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("could not encode decorator: %w", err)
+	}
+	return json.Marshal(decoratorCheckpoint{Decorator: decorator, State: state})
+}
+
+func (d *decorator) restoreSnapshot(data []byte) (int64, error) {
+	var c decoratorCheckpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return 0, fmt.Errorf("could not decode checkpoint: %w", err)
+	}
+
+	offset, err := d.svc.restoreSnapshot(c.State)
+	if err != nil {
+		return 0, err
+	}
+	if err = d.state.UnmarshalJSON(c.Decorator); err != nil {
+		return 0, fmt.Errorf("could not decode decorator: %w", err)
+	}
+	return offset, nil
+}
@@ -0,0 +1,176 @@
+package application
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+	"github.com/lucaslobo/aggregator/internal/core/outboundprt"
+)
+
+// Deduplicator drops the events whose translation id was already seen, before they reach the Calculator it wraps.
+// Only the ids of the events in the last DedupWindow (compared to the most recent event) are kept, which bounds the
+// memory used by the seen-set.
+type Deduplicator struct {
+	decorator
+	rejectedStorer outboundprt.RejectedEventStorer
+
+	window time.Duration
+	// seen holds the timestamp of the first event of each translation id in the window
+	seen map[string]time.Time
+	// expiry orders the ids in seen by their timestamp, so that they can be removed once they leave the window
+	expiry expiryHeap
+	// latest is the timestamp of the most recent event
+	latest time.Time
+
+	duplicates int
+}
+
+// NewDeduplicator creates a Deduplicator that wraps svc. Only the cfg.DedupWindow, cfg.RejectedStorer and
+// cfg.StateStorer are used. The state of svc is checkpointed along with the seen-set using cfg.StateStorer, so svc
+// doesn't use its own.
+func NewDeduplicator(cfg Config, svc Calculator) *Deduplicator {
+	d := &Deduplicator{
+		rejectedStorer: cfg.RejectedStorer,
+		window:         cfg.DedupWindow,
+		seen:           map[string]time.Time{},
+	}
+	d.decorator = newDecorator(svc, cfg.StateStorer, d)
+	return d
+}
+
+// ProcessEvent forwards the event to the wrapped Calculator, unless its translation id was already seen, in which case
+// it's stored as rejected. Events older than the window, or without translation id, can't be checked, so they're always
+// forwarded.
+func (d *Deduplicator) ProcessEvent(ctx context.Context, event domain.TranslationDelivered) error {
+	duplicate, err := d.check(ctx, event)
+	if err != nil || duplicate {
+		return err
+	}
+	return d.svc.ProcessEvent(ctx, event)
+}
+
+// ProcessEvents forwards the events whose translation id wasn't seen yet to the wrapped Calculator, as a single batch.
+// The duplicates are stored as rejected. If a duplicate can't be stored, the events before it are still forwarded, since
+// their ids are already seen, so they'd be dropped as duplicates if they were processed again.
+func (d *Deduplicator) ProcessEvents(ctx context.Context, events []domain.TranslationDelivered) error {
+	unique := make([]domain.TranslationDelivered, 0, len(events))
+	for _, event := range events {
+		duplicate, err := d.check(ctx, event)
+		if err != nil {
+			return errors.Join(d.svc.ProcessEvents(ctx, unique), err)
+		}
+		if !duplicate {
+			unique = append(unique, event)
+		}
+	}
+	return d.svc.ProcessEvents(ctx, unique)
+}
+
+// check returns true if the translation id of the event was already seen, in which case it's stored as rejected.
+// Otherwise, the id is added to the seen-set.
+func (d *Deduplicator) check(ctx context.Context, event domain.TranslationDelivered) (bool, error) {
+	if event.TranslationId == "" {
+		return false, nil
+	}
+
+	if _, ok := d.seen[event.TranslationId]; ok {
+		d.duplicates++
+		if d.rejectedStorer == nil {
+			return true, nil
+		}
+		return true, d.rejectedStorer.StoreRejectedEvent(ctx, domain.RejectedEvent{
+			Reason: domain.RejectionReasonDuplicate,
+			Event:  event,
+		})
+	}
+
+	if event.Timestamp.After(d.latest) {
+		d.latest = event.Timestamp.Time
+		d.expire()
+	}
+	if !event.Timestamp.Before(d.latest.Add(-d.window)) {
+		d.add(event.TranslationId, event.Timestamp.Time)
+	}
+	return false, nil
+}
+
+// Summary returns the summary of the wrapped Calculator, along with the count of duplicate events
+func (d *Deduplicator) Summary() domain.ProcessingSummary {
+	summary := d.svc.Summary()
+	summary.DuplicateEvents = d.duplicates
+	return summary
+}
+
+func (d *Deduplicator) add(id string, timestamp time.Time) {
+	d.seen[id] = timestamp
+	heap.Push(&d.expiry, seenID{id: id, timestamp: timestamp})
+}
+
+// expire removes the ids that are older than the window
+func (d *Deduplicator) expire() {
+	oldest := d.latest.Add(-d.window)
+	for len(d.expiry) > 0 && d.expiry[0].timestamp.Before(oldest) {
+		expired := heap.Pop(&d.expiry).(seenID)
+		delete(d.seen, expired.id)
+	}
+}
+
+// dedupState is the JSON representation of the state of a Deduplicator
+type dedupState struct {
+	Seen       map[string]time.Time `json:"seen"`
+	Latest     time.Time            `json:"latest"`
+	Duplicates int                  `json:"duplicates"`
+}
+
+// MarshalJSON encodes the seen-set and the count of duplicates, which are checkpointed along with the wrapped Calculator
+func (d *Deduplicator) MarshalJSON() ([]byte, error) {
+	return json.Marshal(dedupState{
+		Seen:       d.seen,
+		Latest:     d.latest,
+		Duplicates: d.duplicates,
+	})
+}
+
+func (d *Deduplicator) UnmarshalJSON(data []byte) error {
+	var state dedupState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	d.seen = map[string]time.Time{}
+	d.expiry = nil
+	for id, timestamp := range state.Seen {
+		d.add(id, timestamp)
+	}
+	d.latest = state.Latest
+	d.duplicates = state.Duplicates
+	return nil
+}
+
+// seenID is a translation id along with the timestamp of its event
+type seenID struct {
+	id        string
+	timestamp time.Time
+}
+
+// expiryHeap is a min-heap of ids ordered by their timestamp
+type expiryHeap []seenID
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].timestamp.Before(h[j].timestamp) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x any) {
+	*h = append(*h, x.(seenID))
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
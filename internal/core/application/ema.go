@@ -0,0 +1,292 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+	"github.com/lucaslobo/aggregator/internal/core/outboundprt"
+)
+
+// ExponentialMovingAverage calculates the exponentially weighted moving average of the delivery time. Unlike the
+// Application, it doesn't keep the events of a window: the weight of each event decays with its age, halving every
+// half-life, which only requires O(1) state per group and reacts faster to regressions.
+type ExponentialMovingAverage struct {
+	output         *outputBatch[domain.AverageDeliveryTime]
+	rejectedStorer outboundprt.RejectedEventStorer
+	stateStorer    outboundprt.StateStorer
+	// inputMode identifies what the offsets of the checkpoints count
+	inputMode string
+
+	halfLife time.Duration
+	bucket   time.Duration
+	groupBy  []string
+	// averages holds one exponential moving average per group key
+	averages map[string]*exponentialAverage
+
+	summary domain.ProcessingSummary
+}
+
+// NewExponentialMovingAverage creates an ExponentialMovingAverage. Only the cfg.Bucket, cfg.GroupBy, cfg.RejectedStorer,
+// cfg.StateStorer and cfg.InputMode are used.
+func NewExponentialMovingAverage(cfg Config, halfLife time.Duration, storer outboundprt.MovingAverageStorer) *ExponentialMovingAverage {
+	bucket := cfg.Bucket
+	if bucket <= 0 {
+		bucket = time.Minute
+	}
+
+	return &ExponentialMovingAverage{
+		output: &outputBatch[domain.AverageDeliveryTime]{
+			store:      storer.StoreMovingAverage,
+			storeSlice: storer.StoreMovingAverageSlice,
+		},
+		rejectedStorer: cfg.RejectedStorer,
+		stateStorer:    cfg.StateStorer,
+		inputMode:      cfg.InputMode,
+		halfLife:       halfLife,
+		bucket:         bucket,
+		groupBy:        cfg.GroupBy,
+		averages:       map[string]*exponentialAverage{},
+	}
+}
+
+// exponentialAverage keeps the sums of the durations and of the weights of all events, where the weight of each event
+// decays with the time elapsed since it happened until the latest event. The average is the ratio between both sums.
+type exponentialAverage struct {
+	// group holds the dimension values shared by all the events of this average (nil if there is no grouping)
+	group    map[string]string
+	duration float64
+	weight   float64
+	// latest is the timestamp of the most recent event, which is the reference of the weights
+	latest time.Time
+
+	head time.Time
+}
+
+// add adds the event to the average. The weight of an event is 1 at the time it happened and halves every half-life.
+func (avg *exponentialAverage) add(event domain.TranslationDelivered, halfLife time.Duration) {
+	elapsed := event.Timestamp.Sub(avg.latest)
+	if elapsed >= 0 {
+		// the weights are now relative to the most recent event, so the previous ones decay
+		decay := math.Exp2(-float64(elapsed) / float64(halfLife))
+		avg.duration *= decay
+		avg.weight *= decay
+		avg.duration += float64(event.Duration)
+		avg.weight += 1
+		avg.latest = event.Timestamp.Time
+		return
+	}
+
+	// the event is older than the most recent one (e.g., in the same time-bucket), so it already decayed
+	weight := math.Exp2(float64(elapsed) / float64(halfLife))
+	avg.duration += weight * float64(event.Duration)
+	avg.weight += weight
+}
+
+func (avg *exponentialAverage) value() float32 {
+	if avg.weight == 0 {
+		return 0
+	}
+	return float32(avg.duration / avg.weight)
+}
+
+// ProcessEvent updates the exponential moving average of the event's group and stores it for all time-buckets since
+// the last event of the group until the event's one. Events whose time-bucket was already stored are rejected.
+func (e *ExponentialMovingAverage) ProcessEvent(ctx context.Context, event domain.TranslationDelivered) error {
+	bucket := event.Timestamp.Truncate(e.bucket).Add(e.bucket)
+
+	key, group := groupOf(event, e.groupBy)
+	avg, ok := e.averages[key]
+	if !ok {
+		// we must initialize the values when the first event is processed
+		avg = &exponentialAverage{
+			group:  group,
+			latest: event.Timestamp.Time,
+			head:   bucket.Add(-e.bucket),
+		}
+		e.averages[key] = avg
+	} else if bucket.Before(avg.head) {
+		e.summary.LateEvents++
+		if e.rejectedStorer == nil {
+			return nil
+		}
+		return e.rejectedStorer.StoreRejectedEvent(ctx, domain.RejectedEvent{
+			Reason: domain.RejectionReasonLate,
+			Event:  event,
+		})
+	}
+
+	// the time-buckets before the event's are stored without it, while the event's is only stored once a later event
+	// arrives, so that the other events of the same time-bucket are still part of it
+	if err := e.advance(ctx, avg, bucket.Add(-e.bucket)); err != nil {
+		return err
+	}
+
+	avg.add(event, e.halfLife)
+	e.summary.ProcessedEvents++
+	return nil
+}
+
+// ProcessEvents processes the events in order, like ProcessEvent, but stores the exponential moving averages of all the
+// time-buckets advanced by the batch at once, with StoreMovingAverageSlice
+func (e *ExponentialMovingAverage) ProcessEvents(ctx context.Context, events []domain.TranslationDelivered) error {
+	return processBatch(ctx, e.output, events, e.ProcessEvent)
+}
+
+// AdvanceTo stores the exponential moving average of every group for all the time-buckets that end before or at the
+// provided time, even if no events arrived for them
+func (e *ExponentialMovingAverage) AdvanceTo(ctx context.Context, t time.Time) error {
+	until := t.Truncate(e.bucket)
+	for _, key := range sortedKeys(e.averages) {
+		if err := e.advance(ctx, e.averages[key], until); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush stores the exponential moving average of every group until the time-bucket of its latest event
+func (e *ExponentialMovingAverage) Flush(ctx context.Context) error {
+	for _, key := range sortedKeys(e.averages) {
+		avg := e.averages[key]
+		if err := e.advance(ctx, avg, avg.latest.Truncate(e.bucket).Add(e.bucket)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finish stores the exponential moving average of every group until the time-bucket of the latest event of any group,
+// so that all the groups end at the same time. The average never becomes empty, since the weight of the events only
+// decays.
+func (e *ExponentialMovingAverage) Finish(ctx context.Context) error {
+	var latest time.Time
+	for _, avg := range e.averages {
+		if avg.latest.After(latest) {
+			latest = avg.latest
+		}
+	}
+	if latest.IsZero() {
+		return nil
+	}
+
+	until := latest.Truncate(e.bucket).Add(e.bucket)
+	for _, key := range sortedKeys(e.averages) {
+		if err := e.advance(ctx, e.averages[key], until); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Summary returns the counts of events processed so far
+func (e *ExponentialMovingAverage) Summary() domain.ProcessingSummary {
+	return e.summary
+}
+
+// emaCheckpoint is the JSON representation of the state of an ExponentialMovingAverage
+type emaCheckpoint struct {
+	// InputMode identifies what the Offset counts, since it can't be resumed from an input read in another mode
+	InputMode string `json:"input_mode"`
+	Offset    int64  `json:"offset"`
+	// HalfLife, Bucket and GroupBy are part of the checkpoint since the averages can't be restored with different ones
+	HalfLife time.Duration                         `json:"half_life"`
+	Bucket   time.Duration                         `json:"bucket"`
+	GroupBy  string                                `json:"group_by"`
+	Averages map[string]exponentialAverageSnapshot `json:"averages"`
+	Summary  domain.ProcessingSummary              `json:"summary"`
+}
+
+// exponentialAverageSnapshot is the JSON representation of an exponentialAverage
+type exponentialAverageSnapshot struct {
+	Group    map[string]string `json:"group,omitempty"`
+	Duration float64           `json:"duration"`
+	Weight   float64           `json:"weight"`
+	Latest   time.Time         `json:"latest"`
+	Head     time.Time         `json:"head"`
+}
+
+// Checkpoint stores the averages of all the groups, along with the offset of the input, with the StateStorer, so that
+// they can be restored after a restart. It does nothing if there is no StateStorer.
+func (e *ExponentialMovingAverage) Checkpoint(ctx context.Context, offset int64) error {
+	return checkpointWith(ctx, e, e.stateStorer, offset)
+}
+
+// Restore replaces the averages of all the groups with the last checkpoint stored with the StateStorer, and returns the
+// offset of the input stored along with it. It does nothing if there is no StateStorer or no checkpoint.
+func (e *ExponentialMovingAverage) Restore(ctx context.Context) (int64, error) {
+	return restoreWith(ctx, e, e.stateStorer)
+}
+
+func (e *ExponentialMovingAverage) snapshot(offset int64) ([]byte, error) {
+	c := emaCheckpoint{
+		InputMode: e.inputMode,
+		Offset:    offset,
+		HalfLife:  e.halfLife,
+		Bucket:    e.bucket,
+		GroupBy:   strings.Join(e.groupBy, ","),
+		Averages:  make(map[string]exponentialAverageSnapshot, len(e.averages)),
+		Summary:   e.summary,
+	}
+	for key, avg := range e.averages {
+		c.Averages[key] = exponentialAverageSnapshot{
+			Group:    avg.group,
+			Duration: avg.duration,
+			Weight:   avg.weight,
+			Latest:   avg.latest,
+			Head:     avg.head,
+		}
+	}
+
+	return json.Marshal(c)
+}
+
+func (e *ExponentialMovingAverage) restoreSnapshot(data []byte) (int64, error) {
+	var c emaCheckpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return 0, fmt.Errorf("could not decode checkpoint: %w", err)
+	}
+	if c.InputMode != e.inputMode {
+		return 0, inputModeError(c.InputMode, e.inputMode)
+	}
+	if c.HalfLife != e.halfLife || c.Bucket != e.bucket || c.GroupBy != strings.Join(e.groupBy, ",") {
+		return 0, errors.New("the checkpoint was created with a different half-life, bucket or group by")
+	}
+
+	e.averages = make(map[string]*exponentialAverage, len(c.Averages))
+	for key, avg := range c.Averages {
+		e.averages[key] = &exponentialAverage{
+			group:    avg.Group,
+			duration: avg.Duration,
+			weight:   avg.Weight,
+			latest:   avg.Latest,
+			head:     avg.Head,
+		}
+	}
+	e.summary = c.Summary
+	return c.Offset, nil
+}
+
+// advance stores the average for all the time-buckets until (and including) the provided time-bucket
+func (e *ExponentialMovingAverage) advance(ctx context.Context, avg *exponentialAverage, until time.Time) error {
+	for beforeOrEqual(avg.head, until) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := e.output.add(ctx, domain.AverageDeliveryTime{
+			Date:                domain.NewTime(avg.head, e.bucket),
+			Group:               avg.group,
+			AverageDeliveryTime: avg.value(),
+		})
+		if err != nil {
+			return err
+		}
+		avg.head = avg.head.Add(e.bucket)
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package application
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+)
+
+// predicate reports whether an event matches a filter expression
+type predicate func(event domain.TranslationDelivered) bool
+
+// operand is a value of a comparison: either a field of the event or a literal. Its value is a string or a number.
+type operand struct {
+	name   string
+	number bool
+	str    func(event domain.TranslationDelivered) string
+	num    func(event domain.TranslationDelivered) float64
+}
+
+// fields are the fields of the event that can be used in filter expressions
+var fields = map[string]operand{
+	"translation_id":  stringField("translation_id", func(e domain.TranslationDelivered) string { return e.TranslationId }),
+	"source_language": stringField("source_language", func(e domain.TranslationDelivered) string { return e.SourceLanguage }),
+	"target_language": stringField("target_language", func(e domain.TranslationDelivered) string { return e.TargetLanguage }),
+	"client_name":     stringField("client_name", func(e domain.TranslationDelivered) string { return e.ClientName }),
+	"event_name":      stringField("event_name", func(e domain.TranslationDelivered) string { return e.EventName }),
+	"nr_words":        numberField("nr_words", func(e domain.TranslationDelivered) int { return e.NrWords }),
+	"duration":        numberField("duration", func(e domain.TranslationDelivered) int { return e.Duration }),
+}
+
+func stringField(name string, value func(e domain.TranslationDelivered) string) operand {
+	return operand{name: name, str: value}
+}
+
+func numberField(name string, value func(e domain.TranslationDelivered) int) operand {
+	return operand{name: name, number: true, num: func(e domain.TranslationDelivered) float64 { return float64(value(e)) }}
+}
+
+// tokenKind is the kind of a token of a filter expression
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenLeftParen
+	tokenRightParen
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	// pos is the position of the token in the expression, used in error messages
+	pos int
+}
+
+// operators holds the operators of the language. Two character operators must come first, so that they're matched
+// before their one character prefix.
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!"}
+
+// tokenize splits the expression into tokens
+func tokenize(expression string) ([]token, error) {
+	var tokens []token
+	for pos := 0; pos < len(expression); {
+		c := rune(expression[pos])
+		switch {
+		case unicode.IsSpace(c):
+			pos++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLeftParen, value: "(", pos: pos})
+			pos++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRightParen, value: ")", pos: pos})
+			pos++
+		case c == '"':
+			value, end, err := scanString(expression, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, value: value, pos: pos})
+			pos = end
+		case c == '-' || c == '.' || unicode.IsDigit(c):
+			end := pos + 1
+			for end < len(expression) && (expression[end] == '.' || unicode.IsDigit(rune(expression[end]))) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, value: expression[pos:end], pos: pos})
+			pos = end
+		case c == '_' || unicode.IsLetter(c):
+			end := pos + 1
+			for end < len(expression) && (expression[end] == '_' || unicode.IsLetter(rune(expression[end])) || unicode.IsDigit(rune(expression[end]))) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, value: expression[pos:end], pos: pos})
+			pos = end
+		default:
+			operator := ""
+			for _, op := range operators {
+				if strings.HasPrefix(expression[pos:], op) {
+					operator = op
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, pos)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, value: operator, pos: pos})
+			pos += len(operator)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(expression)}), nil
+}
+
+// scanString returns the value of the string literal that starts at pos, and the position after it. Quotes and
+// backslashes can be escaped with a backslash.
+func scanString(expression string, pos int) (string, int, error) {
+	var value strings.Builder
+	for i := pos + 1; i < len(expression); i++ {
+		switch expression[i] {
+		case '"':
+			return value.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(expression) {
+				break
+			}
+			value.WriteByte(expression[i])
+		default:
+			value.WriteByte(expression[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string at position %d", pos)
+}
+
+// parser is a recursive descent parser of filter expressions, which compiles them into a predicate. The grammar is:
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" or ")" | comparison
+//	comparison = operand ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) operand
+//	operand    = field | string | number
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parseFilter compiles the filter expression into a predicate
+func parseFilter(expression string) (predicate, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	pred, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); next.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", next.value, next.pos)
+	}
+	return pred, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it's the provided operator
+func (p *parser) accept(operator string) bool {
+	if t := p.peek(); t.kind == tokenOperator && t.value == operator {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (predicate, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e domain.TranslationDelivered) bool { return l(e) || right(e) }
+	}
+	return left, nil
+}
+
+func (p *parser) and() (predicate, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e domain.TranslationDelivered) bool { return l(e) && right(e) }
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (predicate, error) {
+	if p.accept("!") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(e domain.TranslationDelivered) bool { return !operand(e) }, nil
+	}
+
+	if p.peek().kind == tokenLeftParen {
+		p.next()
+		pred, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokenRightParen {
+			return nil, fmt.Errorf("expected ) at position %d", t.pos)
+		}
+		return pred, nil
+	}
+
+	return p.comparison()
+}
+
+func (p *parser) comparison() (predicate, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	if op.kind != tokenOperator || op.value == "&&" || op.value == "||" || op.value == "!" {
+		return nil, fmt.Errorf("expected a comparison operator after %s at position %d", left.name, op.pos)
+	}
+
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if left.number != right.number {
+		return nil, fmt.Errorf("cannot compare %s with %s at position %d", left.name, right.name, op.pos)
+	}
+
+	// both operands are compared as numbers or as strings, which results in -1, 0 or 1
+	var compare func(e domain.TranslationDelivered) int
+	if left.number {
+		compare = func(e domain.TranslationDelivered) int {
+			l, r := left.num(e), right.num(e)
+			switch {
+			case l < r:
+				return -1
+			case l > r:
+				return 1
+			}
+			return 0
+		}
+	} else {
+		compare = func(e domain.TranslationDelivered) int { return strings.Compare(left.str(e), right.str(e)) }
+	}
+
+	switch op.value {
+	case "==":
+		return func(e domain.TranslationDelivered) bool { return compare(e) == 0 }, nil
+	case "!=":
+		return func(e domain.TranslationDelivered) bool { return compare(e) != 0 }, nil
+	case "<":
+		return func(e domain.TranslationDelivered) bool { return compare(e) < 0 }, nil
+	case "<=":
+		return func(e domain.TranslationDelivered) bool { return compare(e) <= 0 }, nil
+	case ">":
+		return func(e domain.TranslationDelivered) bool { return compare(e) > 0 }, nil
+	default:
+		return func(e domain.TranslationDelivered) bool { return compare(e) >= 0 }, nil
+	}
+}
+
+func (p *parser) operand() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenIdent:
+		field, ok := fields[t.value]
+		if !ok {
+			return operand{}, fmt.Errorf("unknown field %q at position %d", t.value, t.pos)
+		}
+		return field, nil
+	case tokenString:
+		return operand{name: strconv.Quote(t.value), str: func(domain.TranslationDelivered) string { return t.value }}, nil
+	case tokenNumber:
+		value, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return operand{}, fmt.Errorf("invalid number %q at position %d", t.value, t.pos)
+		}
+		return operand{name: t.value, number: true, num: func(domain.TranslationDelivered) float64 { return value }}, nil
+	case tokenEOF:
+		return operand{}, fmt.Errorf("unexpected end of expression")
+	}
+	return operand{}, fmt.Errorf("expected a field, string or number at position %d, found %q", t.pos, t.value)
+}
@@ -0,0 +1,80 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+)
+
+// Filter only forwards the events that match a filter expression to the Calculator it wraps. The expression compares
+// the fields of the event (e.g., client_name == "airliberty" && nr_words > 50), and supports the ==, !=, <, <=, >, >=,
+// &&, || and ! operators, as well as parentheses.
+type Filter struct {
+	decorator
+
+	matches  predicate
+	filtered int
+}
+
+// NewFilter creates a Filter that wraps svc, or returns an error if the expression is not valid. Only the
+// cfg.StateStorer is used, which checkpoints the state of svc along with the count of filtered events.
+func NewFilter(cfg Config, expression string, svc Calculator) (*Filter, error) {
+	matches, err := parseFilter(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %w", err)
+	}
+
+	f := &Filter{matches: matches}
+	f.decorator = newDecorator(svc, cfg.StateStorer, f)
+	return f, nil
+}
+
+// ProcessEvent forwards the event to the wrapped Calculator if it matches the expression
+func (f *Filter) ProcessEvent(ctx context.Context, event domain.TranslationDelivered) error {
+	if !f.matches(event) {
+		f.filtered++
+		return nil
+	}
+	return f.svc.ProcessEvent(ctx, event)
+}
+
+// ProcessEvents forwards the events that match the expression to the wrapped Calculator, as a single batch
+func (f *Filter) ProcessEvents(ctx context.Context, events []domain.TranslationDelivered) error {
+	matching := make([]domain.TranslationDelivered, 0, len(events))
+	for _, event := range events {
+		if !f.matches(event) {
+			f.filtered++
+			continue
+		}
+		matching = append(matching, event)
+	}
+	return f.svc.ProcessEvents(ctx, matching)
+}
+
+// Summary returns the summary of the wrapped Calculator, along with the count of filtered events
+func (f *Filter) Summary() domain.ProcessingSummary {
+	summary := f.svc.Summary()
+	summary.FilteredEvents = f.filtered
+	return summary
+}
+
+// filterState is the JSON representation of the state of a Filter
+type filterState struct {
+	Filtered int `json:"filtered"`
+}
+
+// MarshalJSON encodes the count of filtered events, which is checkpointed along with the wrapped Calculator
+func (f *Filter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(filterState{Filtered: f.filtered})
+}
+
+func (f *Filter) UnmarshalJSON(data []byte) error {
+	var state filterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	f.filtered = state.Filtered
+	return nil
+}
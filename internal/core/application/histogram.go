@@ -0,0 +1,125 @@
+package application
+
+import (
+	"math"
+	"sort"
+)
+
+// binning maps event durations to histogram bins and back
+type binning interface {
+	bin(duration int) int
+	value(bin int) float64
+}
+
+// exactBinning keeps one bin per distinct duration, which gives exact percentiles. Since durations are integers, the
+// number of bins is bound by the number of distinct durations in the window.
+type exactBinning struct{}
+
+func (exactBinning) bin(duration int) int {
+	return duration
+}
+
+func (exactBinning) value(bin int) float64 {
+	return float64(bin)
+}
+
+// zeroBin is the bin of non-positive durations, which cannot be mapped logarithmically
+const zeroBin = math.MinInt32
+
+// logBinning maps durations to logarithmically sized bins, like DDSketch does. Any percentile is returned with a
+// relative error of at most relativeAccuracy, while the number of bins grows only with the logarithm of the range of
+// durations, which keeps the memory bound for large windows.
+type logBinning struct {
+	gamma    float64
+	logGamma float64
+}
+
+func newLogBinning(relativeAccuracy float64) logBinning {
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return logBinning{
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+	}
+}
+
+func (b logBinning) bin(duration int) int {
+	if duration <= 0 {
+		return zeroBin
+	}
+	return int(math.Ceil(math.Log(float64(duration)) / b.logGamma))
+}
+
+func (b logBinning) value(bin int) float64 {
+	if bin == zeroBin {
+		return 0
+	}
+	return 2 * math.Pow(b.gamma, float64(bin)) / (b.gamma + 1)
+}
+
+// histogram counts how many events fall into each duration bin. Histograms can be added and subtracted, which allows
+// the sliding window to remove the buckets that leave the window without keeping the individual events.
+type histogram struct {
+	binning binning
+	bins    map[int]int
+	count   int
+}
+
+func newHistogram(b binning) *histogram {
+	return &histogram{
+		binning: b,
+		bins:    map[int]int{},
+	}
+}
+
+func (h *histogram) add(duration int) {
+	h.bins[h.binning.bin(duration)]++
+	h.count++
+}
+
+func (h *histogram) merge(other *histogram) {
+	for bin, count := range other.bins {
+		h.bins[bin] += count
+	}
+	h.count += other.count
+}
+
+func (h *histogram) subtract(other *histogram) {
+	for bin, count := range other.bins {
+		h.bins[bin] -= count
+		if h.bins[bin] <= 0 {
+			delete(h.bins, bin)
+		}
+	}
+	h.count -= other.count
+}
+
+// quantiles returns the value of each one of the provided quantiles (0 < q <= 1) using the nearest-rank method.
+// All quantiles are 0 if the histogram is empty.
+func (h *histogram) quantiles(qs []float64) []float64 {
+	values := make([]float64, len(qs))
+	if h.count == 0 {
+		return values
+	}
+
+	bins := make([]int, 0, len(h.bins))
+	for bin := range h.bins {
+		bins = append(bins, bin)
+	}
+	sort.Ints(bins)
+
+	for i, q := range qs {
+		rank := int(math.Ceil(q * float64(h.count)))
+		if rank < 1 {
+			rank = 1
+		}
+		cumulative := 0
+		for _, bin := range bins {
+			cumulative += h.bins[bin]
+			if cumulative >= rank {
+				values[i] = h.binning.value(bin)
+				break
+			}
+		}
+	}
+	return values
+}
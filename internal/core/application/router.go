@@ -0,0 +1,141 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+	"github.com/lucaslobo/aggregator/internal/core/outboundprt"
+)
+
+// Router decodes the events read by the inbound adapters according to their name, and dispatches them to the handler
+// registered for it. The translation_delivered events are handled by the Calculator it wraps. Events of a known type
+// without handler are ignored, while the ones whose type is unknown are stored as rejected.
+type Router struct {
+	decorator
+	rejectedStorer outboundprt.RejectedEventStorer
+
+	handlers map[string]func(ctx context.Context, event any) error
+	// batchDelivered is true while the translation_delivered events are handled by the wrapped Calculator, whose
+	// ProcessEvents can then process them in batches
+	batchDelivered bool
+
+	unknown int
+	ignored int
+}
+
+// NewRouter creates a Router that wraps svc. Only the cfg.RejectedStorer and cfg.StateStorer are used, which
+// checkpoints the state of svc along with the counts of unknown and ignored events.
+func NewRouter(cfg Config, svc Calculator) *Router {
+	r := &Router{
+		rejectedStorer: cfg.RejectedStorer,
+		handlers:       map[string]func(ctx context.Context, event any) error{},
+	}
+	r.decorator = newDecorator(svc, cfg.StateStorer, r)
+	r.Register(domain.EventNameTranslationDelivered, func(ctx context.Context, event any) error {
+		return svc.ProcessEvent(ctx, event.(domain.TranslationDelivered))
+	})
+	r.batchDelivered = true
+	return r
+}
+
+// Register sets the handler of the events with the provided name, which receives them as the type registered with
+// domain.RegisterEventType. The state of the handler isn't part of the checkpoints of the Router.
+func (r *Router) Register(name string, handle func(ctx context.Context, event any) error) {
+	r.handlers[name] = handle
+	if name == domain.EventNameTranslationDelivered {
+		r.batchDelivered = false
+	}
+}
+
+// Route decodes the event according to its name and dispatches it to its handler
+func (r *Router) Route(ctx context.Context, envelope domain.Envelope) error {
+	event, err := envelope.Decode()
+	if errors.Is(err, domain.ErrUnknownEvent) {
+		r.unknown++
+		if r.rejectedStorer == nil {
+			return nil
+		}
+		return r.rejectedStorer.StoreRejectedEvent(ctx, domain.RejectedEvent{
+			Reason: domain.RejectionReasonUnknownEvent,
+			Event:  envelope,
+		})
+	} else if err != nil {
+		return err
+	}
+
+	handle, ok := r.handlers[envelope.Name]
+	if !ok {
+		r.ignored++
+		return nil
+	}
+	return handle(ctx, event)
+}
+
+// RouteEvents routes the events in order, like Route, but the consecutive translation_delivered events are processed
+// at once with ProcessEvents of the wrapped Calculator, so that its output is stored in bulk. If an event can't be
+// routed, the events before it are still processed.
+func (r *Router) RouteEvents(ctx context.Context, envelopes []domain.Envelope) error {
+	var delivered []domain.TranslationDelivered
+	flush := func() error {
+		if len(delivered) == 0 {
+			return nil
+		}
+		err := r.svc.ProcessEvents(ctx, delivered)
+		delivered = nil
+		return err
+	}
+
+	for _, envelope := range envelopes {
+		if !r.batchDelivered || envelope.Name != domain.EventNameTranslationDelivered {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := r.Route(ctx, envelope); err != nil {
+				return err
+			}
+			continue
+		}
+
+		event, err := envelope.Decode()
+		if err != nil {
+			if flushErr := flush(); flushErr != nil {
+				return flushErr
+			}
+			return err
+		}
+		delivered = append(delivered, event.(domain.TranslationDelivered))
+	}
+	return flush()
+}
+
+// Summary returns the summary of the wrapped Calculator, along with the counts of unknown and ignored events
+func (r *Router) Summary() domain.ProcessingSummary {
+	summary := r.svc.Summary()
+	summary.UnknownEvents = r.unknown
+	summary.IgnoredEvents = r.ignored
+	return summary
+}
+
+// routerState is the JSON representation of the state of a Router
+type routerState struct {
+	Unknown int `json:"unknown"`
+	Ignored int `json:"ignored"`
+}
+
+// MarshalJSON encodes the counts of unknown and ignored events, which are checkpointed along with the wrapped
+// Calculator
+func (r *Router) MarshalJSON() ([]byte, error) {
+	return json.Marshal(routerState{Unknown: r.unknown, Ignored: r.ignored})
+}
+
+func (r *Router) UnmarshalJSON(data []byte) error {
+	var state routerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	r.unknown = state.Unknown
+	r.ignored = state.Ignored
+	return nil
+}
@@ -0,0 +1,175 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+)
+
+// sessionWindow aggregates the events of a group into sessions: a session starts with an event and ends once there
+// are no events for gap. Its aggregation is stored when the session ends, dated at its end (i.e., the last event of
+// the session plus the gap).
+type sessionWindow struct {
+	gap             time.Duration
+	allowedLateness time.Duration
+	store           func(ctx context.Context, r result) error
+
+	// pending holds the events after the watermark, which may still be followed by late events
+	pending []domain.TranslationDelivered
+	// watermark is the time until which the events were already added to the sessions. Older events are too late.
+	watermark time.Time
+	// latest is the timestamp of the most recent event of the window
+	latest time.Time
+	// group holds the dimension values shared by all the events in this window (nil if there is no grouping)
+	group map[string]string
+	// accumulators creates the set of accumulators used by each session
+	accumulators []func() accumulator
+
+	// state is the aggregation of the current session, which is nil when there is none
+	state state
+	start time.Time
+	last  time.Time
+}
+
+// process buffers the event until the watermark (the latest event timestamp minus the allowed lateness) passes it, so
+// that late events are added to the sessions in order
+func (s *sessionWindow) process(ctx context.Context, event domain.TranslationDelivered) (bool, error) {
+	if event.Timestamp.Before(s.watermark) {
+		return false, nil
+	}
+
+	s.pending = append(s.pending, event)
+	if event.Timestamp.After(s.latest) {
+		s.latest = event.Timestamp.Time
+	}
+
+	return true, s.advance(ctx, s.latest.Add(-s.allowedLateness))
+}
+
+// advance adds the events until the provided time to the sessions, storing the sessions that end before or at it
+func (s *sessionWindow) advance(ctx context.Context, t time.Time) error {
+	if !t.After(s.watermark) {
+		return nil
+	}
+	s.watermark = t
+
+	sort.SliceStable(s.pending, func(i, j int) bool {
+		return s.pending[i].Timestamp.Before(s.pending[j].Timestamp.Time)
+	})
+
+	added := 0
+	for _, event := range s.pending {
+		if event.Timestamp.After(t) {
+			break
+		}
+		if err := s.add(ctx, event); err != nil {
+			return err
+		}
+		added++
+	}
+	s.pending = s.pending[added:]
+
+	if s.state != nil && beforeOrEqual(s.last.Add(s.gap), t) {
+		return s.close(ctx)
+	}
+	return nil
+}
+
+// flush adds the pending events to the sessions, without waiting for the allowed lateness. The current session is
+// only stored once the gap passes.
+func (s *sessionWindow) flush(ctx context.Context) error {
+	return s.advance(ctx, s.latest)
+}
+
+// finish adds the pending events to the sessions, and stores the current session, as if the gap had passed after the
+// latest event
+func (s *sessionWindow) finish(ctx context.Context) error {
+	return s.advance(ctx, s.latest.Add(s.gap))
+}
+
+// add adds the event to the current session, unless it's too far from its last event, in which case a new session
+// is started
+func (s *sessionWindow) add(ctx context.Context, event domain.TranslationDelivered) error {
+	if s.state != nil && event.Timestamp.Sub(s.last) >= s.gap {
+		if err := s.close(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.state == nil {
+		s.state = newState(s.accumulators)
+		s.start = event.Timestamp.Time
+	}
+	s.state.add(event)
+	s.last = event.Timestamp.Time
+	return nil
+}
+
+// close stores the aggregation of the current session
+func (s *sessionWindow) close(ctx context.Context) error {
+	start := domain.NewTime(s.start, time.Second)
+	err := s.store(ctx, result{
+		date:   domain.NewTime(s.last.Add(s.gap), time.Second),
+		start:  &start,
+		group:  s.group,
+		states: []state{s.state},
+	})
+	s.state = nil
+	return err
+}
+
+// sessionWindowSnapshot is the JSON representation of a sessionWindow
+type sessionWindowSnapshot struct {
+	Group     map[string]string             `json:"group,omitempty"`
+	Pending   []domain.TranslationDelivered `json:"pending,omitempty"`
+	Watermark time.Time                     `json:"watermark"`
+	Latest    time.Time                     `json:"latest"`
+	// State is null when there is no current session
+	State json.RawMessage `json:"state"`
+	Start time.Time       `json:"start"`
+	Last  time.Time       `json:"last"`
+}
+
+func (s *sessionWindow) MarshalJSON() ([]byte, error) {
+	state, err := json.Marshal(s.state)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(sessionWindowSnapshot{
+		Group:     s.group,
+		Pending:   s.pending,
+		Watermark: s.watermark,
+		Latest:    s.latest,
+		State:     state,
+		Start:     s.start,
+		Last:      s.last,
+	})
+}
+
+func (s *sessionWindow) UnmarshalJSON(data []byte) error {
+	var snapshot sessionWindowSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	s.state = nil
+	if string(snapshot.State) != "null" {
+		state, err := decodeState(s.accumulators, snapshot.State)
+		if err != nil {
+			return err
+		}
+		s.state = state
+	}
+
+	s.group = snapshot.Group
+	s.pending = snapshot.Pending
+	s.watermark = snapshot.Watermark
+	s.latest = snapshot.Latest
+	s.start = snapshot.Start
+	s.last = snapshot.Last
+	return nil
+}
@@ -0,0 +1,473 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+)
+
+// Types of window that can be used by the Application
+const (
+	// WindowTypeSliding is a window that moves one time-bucket at a time, so each event is part of several windows
+	WindowTypeSliding = "sliding"
+	// WindowTypeTumbling is a window that moves its whole size at a time, so windows don't overlap (e.g., daily)
+	WindowTypeTumbling = "tumbling"
+	// WindowTypeHopping is a window that moves a fixed hop at a time, which is usually smaller than its size
+	WindowTypeHopping = "hopping"
+	// WindowTypeSession is a window that groups events until there is a gap of inactivity
+	WindowTypeSession = "session"
+)
+
+// AvailableWindowTypes lists the names of all the types of window that can be used by the Application
+var AvailableWindowTypes = []string{WindowTypeSliding, WindowTypeTumbling, WindowTypeHopping, WindowTypeSession}
+
+// IsWindowType returns true if the name is one of the AvailableWindowTypes
+func IsWindowType(name string) bool {
+	for _, windowType := range AvailableWindowTypes {
+		if name == windowType {
+			return true
+		}
+	}
+	return false
+}
+
+// window aggregates the events of one group over time, storing the aggregation of each of its positions once no more
+// events are expected for it
+type window interface {
+	// process adds the event to the window and stores the aggregations that are complete afterwards. It returns false
+	// (without storing anything) if the event is too late to be aggregated.
+	process(ctx context.Context, event domain.TranslationDelivered) (bool, error)
+	// advance stores the aggregations that are complete at the provided time, even if no events arrived for them
+	advance(ctx context.Context, t time.Time) error
+	// flush stores the aggregations until the one of the latest event, as if no more late events were coming
+	flush(ctx context.Context) error
+	// finish stores the aggregations until the window is empty, as if no more events were coming
+	finish(ctx context.Context) error
+	// windows are encoded as JSON to checkpoint their state. They're decoded into a new window of the same type.
+	json.Marshaler
+	json.Unmarshaler
+}
+
+// result is the aggregation of the events of a window when it's stored
+type result struct {
+	// date is the end of the window
+	date domain.Time
+	// start is the beginning of the window. It's only set by windows whose duration varies (e.g., sessions).
+	start *domain.Time
+	group map[string]string
+	// states holds the aggregation of each window size. Windows with a single size (e.g., sessions) have one state.
+	states []state
+}
+
+// state holds one accumulator of each kind used by the Application
+type state []accumulator
+
+func (s state) add(event domain.TranslationDelivered) {
+	for _, acc := range s {
+		acc.add(event)
+	}
+}
+
+func (s state) merge(other state) {
+	for i, acc := range s {
+		acc.merge(other[i])
+	}
+}
+
+func newState(accumulators []func() accumulator) state {
+	s := make(state, len(accumulators))
+	for i, newAccumulator := range accumulators {
+		s[i] = newAccumulator()
+	}
+	return s
+}
+
+// decodeState creates a new state from its JSON representation
+func decodeState(accumulators []func() accumulator, data json.RawMessage) (state, error) {
+	var encoded []json.RawMessage
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+	if len(encoded) != len(accumulators) {
+		return nil, fmt.Errorf("state has %d accumulators instead of %d", len(encoded), len(accumulators))
+	}
+
+	s := newState(accumulators)
+	for i, acc := range s {
+		if err := acc.UnmarshalJSON(encoded[i]); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// encodeStates returns the JSON representation of each state of the map
+func encodeStates(states map[time.Time]state) (map[time.Time]json.RawMessage, error) {
+	encoded := make(map[time.Time]json.RawMessage, len(states))
+	for t, s := range states {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		encoded[t] = data
+	}
+	return encoded, nil
+}
+
+// decodeStates creates the states of the map from their JSON representation
+func decodeStates(accumulators []func() accumulator, encoded map[time.Time]json.RawMessage) (map[time.Time]state, error) {
+	states := make(map[time.Time]state, len(encoded))
+	for t, data := range encoded {
+		s, err := decodeState(accumulators, data)
+		if err != nil {
+			return nil, err
+		}
+		states[t] = s
+	}
+	return states, nil
+}
+
+// slidingWindow aggregates the events of the last windowSizes time-buckets. Its head moves one time-bucket at a time,
+// but the aggregation is only stored every hop, which makes it a tumbling window when the hop is the size of the window
+// and a hopping window when it's in between. Several window sizes can be aggregated at once, sharing the same
+// time-buckets.
+type slidingWindow struct {
+	windowSizes []int
+	bucket      time.Duration
+	// hop is how often the aggregation is stored. It's a multiple of bucket.
+	hop             time.Duration
+	allowedLateness time.Duration
+	skipEmpty       bool
+	store           func(ctx context.Context, r result) error
+
+	// buckets holds the time-buckets in the largest window that have events, which are already part of its state
+	buckets map[time.Time]state
+	// pending holds the time-buckets after the head, whose events are waiting for the watermark to pass them
+	pending map[time.Time]state
+	// states holds the aggregation of each window size, and counts the number of time-buckets with events in each one
+	states []state
+	counts []int
+	// latest is the timestamp of the most recent event of the window
+	latest time.Time
+	// group holds the dimension values shared by all the events in this window (nil if there is no grouping)
+	group map[string]string
+	// accumulators creates the set of accumulators used by each time-bucket
+	accumulators []func() accumulator
+
+	// emptyStored is true when the aggregation of the last stored time-bucket was empty
+	emptyStored bool
+	// evicted is the position of the head whose time-buckets were already evicted, so that they're not evicted again
+	// when its aggregation can't be stored and the head stays there
+	evicted time.Time
+
+	start time.Time
+	head  time.Time
+}
+
+// evict removes the time-bucket that leaves each window size when the head moves to its current position. Time-buckets
+// are only dropped once they leave the largest window. It does nothing if they were already evicted at this position.
+func (sw *slidingWindow) evict() {
+	if sw.evicted.Equal(sw.head) {
+		return
+	}
+	sw.evicted = sw.head
+
+	for i, size := range sw.windowSizes {
+		tail := sw.tail(size)
+		evicted, ok := sw.buckets[tail]
+		if !ok {
+			continue
+		}
+
+		sw.counts[i]--
+		if sw.counts[i] == 0 {
+			// there are no events left, so we can simply start over
+			sw.states[i] = newState(sw.accumulators)
+			continue
+		}
+
+		for j, acc := range sw.states[i] {
+			if acc.subtract(evicted[j]) {
+				continue
+			}
+			// the accumulator can't be inverted, so it must be rebuilt from the buckets that are left
+			acc = sw.accumulators[j]()
+			for t, bucket := range sw.buckets {
+				if t.After(tail) {
+					acc.merge(bucket[j])
+				}
+			}
+			sw.states[i][j] = acc
+		}
+	}
+
+	delete(sw.buckets, sw.tail(sw.largest()))
+}
+
+// tail returns the time-bucket that leaves the window of the provided size at the current position of the head
+func (sw *slidingWindow) tail(size int) time.Time {
+	return sw.head.Add(-time.Duration(size) * sw.bucket)
+}
+
+// largest returns the largest window size, which determines the time-buckets that are kept
+func (sw *slidingWindow) largest() int {
+	largest := 0
+	for _, size := range sw.windowSizes {
+		largest = max(largest, size)
+	}
+	return largest
+}
+
+// reset rebuilds the aggregation of each window size from the time-buckets that are part of it, when the head is at
+// its current position
+func (sw *slidingWindow) reset() {
+	sw.states = make([]state, len(sw.windowSizes))
+	sw.counts = make([]int, len(sw.windowSizes))
+	for i, size := range sw.windowSizes {
+		sw.states[i] = newState(sw.accumulators)
+		tail := sw.tail(size)
+		for t, bucket := range sw.buckets {
+			if t.After(tail) {
+				sw.states[i].merge(bucket)
+				sw.counts[i]++
+			}
+		}
+	}
+}
+
+// seed starts the window at the provided time, instead of at its first event, so that the first stored time-bucket is
+// the one right after it. Events before it are too late.
+func (sw *slidingWindow) seed(start time.Time) {
+	sw.start = start.Truncate(sw.bucket)
+	sw.head = sw.start.Add(sw.bucket)
+	sw.reset()
+}
+
+// process adds the event to its time-bucket and calculates the moving aggregation for all time-buckets up to the
+// watermark of the window. The watermark is the latest event timestamp minus the allowed lateness, which means that
+// time-buckets are only emitted when no more events are expected for them. If this is the first event of the window
+// it initializes its time-buckets.
+func (sw *slidingWindow) process(ctx context.Context, event domain.TranslationDelivered) (bool, error) {
+	bucket := event.Timestamp.Truncate(sw.bucket).Add(sw.bucket)
+
+	// we must initialize the values when the first event is processed. Events are allowed to be late, so the window
+	// must start early enough to accept them
+	if sw.start.IsZero() {
+		start := event.Timestamp.Add(-sw.allowedLateness).Truncate(sw.bucket)
+		sw.start = start
+		sw.head = start
+		sw.reset()
+	}
+
+	if bucket.Before(sw.head) {
+		return false, nil
+	}
+
+	pending, ok := sw.pending[bucket]
+	if !ok {
+		pending = newState(sw.accumulators)
+		sw.pending[bucket] = pending
+	}
+	pending.add(event)
+
+	if event.Timestamp.After(sw.latest) {
+		sw.latest = event.Timestamp.Time
+	}
+	watermark := sw.latest.Add(-sw.allowedLateness).Truncate(sw.bucket)
+
+	return true, sw.advanceTo(ctx, watermark)
+}
+
+// advance calculates the moving aggregation for all the time-buckets that end before or at the provided time
+func (sw *slidingWindow) advance(ctx context.Context, t time.Time) error {
+	return sw.advanceTo(ctx, t.Truncate(sw.bucket))
+}
+
+// flush advances the head to the time-bucket of the latest event, without waiting for the allowed lateness
+func (sw *slidingWindow) flush(ctx context.Context) error {
+	if sw.latest.IsZero() {
+		return nil
+	}
+	return sw.advanceTo(ctx, sw.latest.Truncate(sw.bucket).Add(sw.bucket))
+}
+
+// finish advances the head until the last time-bucket with events leaves the largest window, so that the last stored
+// aggregation is the last one that has events
+func (sw *slidingWindow) finish(ctx context.Context) error {
+	last := sw.latest.Truncate(sw.bucket).Add(sw.bucket)
+	return sw.advanceTo(ctx, last.Add(time.Duration(sw.largest()-1)*sw.bucket))
+}
+
+// advanceTo calculates the moving aggregation for all the time-buckets of the window until (and including) the provided
+// time-bucket
+func (sw *slidingWindow) advanceTo(ctx context.Context, until time.Time) error {
+	// We must iterate X times until we get to the provided time bucket
+	for beforeOrEqual(sw.head, until) {
+		// the head is always at the next time-bucket to store, so the window can continue where it was cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// when the window is empty, the time-buckets until the next one with events have the same (empty) aggregation
+		if len(sw.buckets) == 0 {
+			if err := sw.advanceEmpty(ctx, until); err != nil {
+				return err
+			}
+			if sw.head.After(until) {
+				break
+			}
+		}
+
+		// when there were events in the current time bucket, we add them to the state
+		current, ok := sw.pending[sw.head]
+		if ok {
+			delete(sw.pending, sw.head)
+			for i, s := range sw.states {
+				s.merge(current)
+				sw.counts[i]++
+			}
+			sw.buckets[sw.head] = current
+		}
+
+		// the oldest time-bucket leaves the window as the head advances
+		sw.evict()
+
+		// once we're done, we store the aggregation for the current position
+		err := sw.storeWindow(ctx)
+		if err != nil {
+			return err
+		}
+
+		// at the end we must advance the head to keep going
+		sw.head = sw.head.Add(sw.bucket)
+	}
+	return nil
+}
+
+// advanceEmpty moves the head of an empty window, in a single step, to the next time-bucket with events (or past until,
+// if there is none), storing the empty aggregation of the time-buckets in between. This way, large gaps between events
+// don't require going through each time-bucket's state.
+func (sw *slidingWindow) advanceEmpty(ctx context.Context, until time.Time) error {
+	next := until.Add(sw.bucket)
+	for bucket := range sw.pending {
+		if bucket.Before(next) {
+			next = bucket
+		}
+	}
+
+	for head := alignUp(sw.head, sw.hop); head.Before(next); head = head.Add(sw.hop) {
+		sw.head = head
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := sw.storeWindow(ctx); err != nil {
+			return err
+		}
+		if sw.skipEmpty {
+			// only the first time-bucket of a run of empty ones is stored
+			break
+		}
+	}
+	if sw.head.Before(next) {
+		sw.head = next
+	}
+	return nil
+}
+
+// storeWindow stores the aggregation of the window for the current head, if it's at a hop. When skipping empty
+// time-buckets, the aggregation is only stored if it's not empty, or if it's the first empty one after one that wasn't.
+func (sw *slidingWindow) storeWindow(ctx context.Context) error {
+	if !sw.head.Truncate(sw.hop).Equal(sw.head) {
+		return nil
+	}
+
+	empty := len(sw.buckets) == 0
+	if sw.skipEmpty && empty && sw.emptyStored {
+		return nil
+	}
+	sw.emptyStored = empty
+	return sw.store(ctx, result{
+		date:   domain.NewTime(sw.head, sw.hop),
+		group:  sw.group,
+		states: sw.states,
+	})
+}
+
+// slidingWindowSnapshot is the JSON representation of a slidingWindow. Its states are not part of it, since they're
+// the merge of its buckets.
+type slidingWindowSnapshot struct {
+	Group       map[string]string             `json:"group,omitempty"`
+	Start       time.Time                     `json:"start"`
+	Head        time.Time                     `json:"head"`
+	Latest      time.Time                     `json:"latest"`
+	EmptyStored bool                          `json:"empty_stored"`
+	Buckets     map[time.Time]json.RawMessage `json:"buckets"`
+	Pending     map[time.Time]json.RawMessage `json:"pending"`
+}
+
+func (sw *slidingWindow) MarshalJSON() ([]byte, error) {
+	buckets, err := encodeStates(sw.buckets)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := encodeStates(sw.pending)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(slidingWindowSnapshot{
+		Group:       sw.group,
+		Start:       sw.start,
+		Head:        sw.head,
+		Latest:      sw.latest,
+		EmptyStored: sw.emptyStored,
+		Buckets:     buckets,
+		Pending:     pending,
+	})
+}
+
+func (sw *slidingWindow) UnmarshalJSON(data []byte) error {
+	var snapshot slidingWindowSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	buckets, err := decodeStates(sw.accumulators, snapshot.Buckets)
+	if err != nil {
+		return err
+	}
+	pending, err := decodeStates(sw.accumulators, snapshot.Pending)
+	if err != nil {
+		return err
+	}
+
+	sw.group = snapshot.Group
+	sw.start = snapshot.Start
+	sw.head = snapshot.Head
+	sw.latest = snapshot.Latest
+	sw.emptyStored = snapshot.EmptyStored
+	sw.buckets = buckets
+	sw.pending = pending
+	// the states are the ones of the last stored position, which is the time-bucket before the head
+	head := sw.head
+	sw.head = head.Add(-sw.bucket)
+	sw.reset()
+	sw.head = head
+	return nil
+}
+
+// alignUp returns the first time at or after t that is a multiple of d
+func alignUp(t time.Time, d time.Duration) time.Time {
+	aligned := t.Truncate(d)
+	if aligned.Before(t) {
+		aligned = aligned.Add(d)
+	}
+	return aligned
+}
+
+func beforeOrEqual(a, b time.Time) bool {
+	return a.Before(b) || a.Equal(b)
+}
@@ -0,0 +1,43 @@
+package domain
+
+// Names of the TranslationDelivered dimensions that can be used to group events
+const (
+	DimensionClientName     = "client_name"
+	DimensionSourceLanguage = "source_language"
+	DimensionTargetLanguage = "target_language"
+	DimensionEventName      = "event_name"
+)
+
+// Dimensions lists the names of all the TranslationDelivered dimensions
+var Dimensions = []string{
+	DimensionClientName,
+	DimensionSourceLanguage,
+	DimensionTargetLanguage,
+	DimensionEventName,
+}
+
+// IsDimension returns true if name is the name of a TranslationDelivered dimension
+func IsDimension(name string) bool {
+	for _, d := range Dimensions {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Dimension returns the value of the dimension with the provided name. It returns false if there is no such dimension.
+func (e TranslationDelivered) Dimension(name string) (string, bool) {
+	switch name {
+	case DimensionClientName:
+		return e.ClientName, true
+	case DimensionSourceLanguage:
+		return e.SourceLanguage, true
+	case DimensionTargetLanguage:
+		return e.TargetLanguage, true
+	case DimensionEventName:
+		return e.EventName, true
+	default:
+		return "", false
+	}
+}
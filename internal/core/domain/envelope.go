@@ -0,0 +1,115 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Names of the known types of events
+const (
+	EventNameTranslationDelivered = "translation_delivered"
+	EventNameTranslationRequested = "translation_requested"
+	EventNameTranslationCancelled = "translation_cancelled"
+)
+
+// ErrUnknownEvent is returned when decoding an event whose name isn't registered
+var ErrUnknownEvent = errors.New("unknown event")
+
+// eventTypes holds the decoder of each known type of event, by its name
+var eventTypes = map[string]func(data []byte) (any, error){}
+
+func init() {
+	RegisterEventType[TranslationDelivered](EventNameTranslationDelivered)
+	RegisterEventType[TranslationRequested](EventNameTranslationRequested)
+	RegisterEventType[TranslationCancelled](EventNameTranslationCancelled)
+}
+
+// RegisterEventType registers T as the type of the events with the provided name, which makes Envelope.Decode return
+// them as a T. It's not safe to call concurrently with Envelope.Decode, so types must be registered on startup.
+func RegisterEventType[T any](name string) {
+	eventTypes[name] = func(data []byte) (any, error) {
+		var event T
+		err := json.Unmarshal(data, &event)
+		return event, err
+	}
+}
+
+// Envelope is an event of any type, as read by the inbound adapters. Only its name is decoded, so that it can be
+// routed without knowing its type.
+type Envelope struct {
+	Name string
+	// payload is the whole event, including its name
+	payload json.RawMessage
+	// timestamp is kept undecoded, and only parsed when needed (e.g., to merge events by their timestamps)
+	timestamp json.RawMessage
+
+	// predecoded is set once the payload is decoded ahead by Predecode, along with its result
+	predecoded bool
+	event      any
+	err        error
+}
+
+// UnmarshalJSON decodes the name of the event, and keeps a copy of the data to decode it later
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	var header struct {
+		EventName string          `json:"event_name"`
+		Timestamp json.RawMessage `json:"timestamp"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+
+	e.Name = header.EventName
+	e.timestamp = header.Timestamp
+	// the data may be reused by the decoder (e.g., a bufio.Scanner), so it must be copied
+	e.payload = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// MarshalJSON encodes the event as it was decoded
+func (e Envelope) MarshalJSON() ([]byte, error) {
+	if e.payload == nil {
+		return []byte("null"), nil
+	}
+	return e.payload, nil
+}
+
+// Timestamp returns the timestamp of the event, whatever its type, or the zero time if it has none
+func (e Envelope) Timestamp() (time.Time, error) {
+	if e.timestamp == nil {
+		return time.Time{}, nil
+	}
+	var timestamp Time
+	err := timestamp.UnmarshalJSON(e.timestamp)
+	return timestamp.Time, err
+}
+
+// Predecode decodes the event ahead, so that Decode returns it without decoding it again. This way, the events can be
+// decoded concurrently (e.g., by a pool of decoders), and then routed in order.
+func (e *Envelope) Predecode() {
+	e.event, e.err = e.decode()
+	e.predecoded = true
+}
+
+// Decode returns the event as the type registered for its name, or ErrUnknownEvent if there is none
+func (e Envelope) Decode() (any, error) {
+	if e.predecoded {
+		return e.event, e.err
+	}
+	return e.decode()
+}
+
+func (e Envelope) decode() (any, error) {
+	decode, ok := eventTypes[e.Name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownEvent, e.Name)
+	}
+
+	event, err := decode(e.payload)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s event: %w", e.Name, err)
+	}
+	return event, nil
+}
@@ -1,5 +1,9 @@
 package domain
 
+import (
+	"encoding/json"
+)
+
 // TranslationDelivered is an event that represents the delivery time of a translation.
 type TranslationDelivered struct {
 	Timestamp      Time   `json:"timestamp"`
@@ -12,8 +16,104 @@ type TranslationDelivered struct {
 	Duration       int    `json:"duration"`
 }
 
+// MarshalJSON encodes the event in the same format it's decoded from
+func (e TranslationDelivered) MarshalJSON() ([]byte, error) {
+	// the alias type doesn't have the MarshalJSON method, which avoids an infinite recursion
+	type event TranslationDelivered
+	return json.Marshal(struct {
+		event
+		Timestamp string `json:"timestamp"`
+	}{
+		event:     event(e),
+		Timestamp: e.Timestamp.Format(inputTimeLayout),
+	})
+}
+
+// TranslationRequested is an event that represents the request of a translation.
+type TranslationRequested struct {
+	Timestamp      Time   `json:"timestamp"`
+	TranslationId  string `json:"translation_id"`
+	SourceLanguage string `json:"source_language"`
+	TargetLanguage string `json:"target_language"`
+	ClientName     string `json:"client_name"`
+	EventName      string `json:"event_name"`
+	NrWords        int    `json:"nr_words"`
+}
+
+// TranslationCancelled is an event that represents the cancellation of a requested translation.
+type TranslationCancelled struct {
+	Timestamp     Time   `json:"timestamp"`
+	TranslationId string `json:"translation_id"`
+	ClientName    string `json:"client_name"`
+	EventName     string `json:"event_name"`
+}
+
 // AverageDeliveryTime represents the average delivery time.
 type AverageDeliveryTime struct {
-	Date                Time    `json:"date"`
-	AverageDeliveryTime float32 `json:"average_delivery_time"`
+	// Date is only empty for the aggregations in Windows, whose Date is the one of the record
+	Date Time `json:"date,omitzero"`
+	// WindowStart is only set for windows whose duration varies (e.g., sessions), whose end is the Date
+	WindowStart *Time `json:"window_start,omitempty"`
+	// Group holds the dimension values of the group the average refers to. It's empty when events are not grouped.
+	Group               map[string]string `json:"group,omitempty"`
+	AverageDeliveryTime float32           `json:"average_delivery_time"`
+
+	// The following metrics are optional, and only set when requested
+	MinDeliveryTime   *int `json:"min_delivery_time,omitempty"`
+	MaxDeliveryTime   *int `json:"max_delivery_time,omitempty"`
+	TotalDeliveryTime *int `json:"total_delivery_time,omitempty"`
+	Count             *int `json:"count,omitempty"`
+	TotalWords        *int `json:"total_words,omitempty"`
+	// SecondsPerWord is the total delivery time divided by the total number of words
+	SecondsPerWord *float32 `json:"seconds_per_word,omitempty"`
+
+	// Windows holds the aggregation of each window size (e.g., 15m), when several of them are calculated at once. The
+	// record's own aggregation is the one of the first window size.
+	Windows map[string]AverageDeliveryTime `json:"windows,omitempty"`
+}
+
+// PercentileDeliveryTime represents percentiles (e.g., p50, p90, p99) of the delivery time.
+type PercentileDeliveryTime struct {
+	// Date is only empty for the aggregations in Windows, whose Date is the one of the record
+	Date Time `json:"date,omitzero"`
+	// WindowStart is only set for windows whose duration varies (e.g., sessions), whose end is the Date
+	WindowStart *Time `json:"window_start,omitempty"`
+	// Group holds the dimension values of the group the percentiles refer to. It's empty when events are not grouped.
+	Group       map[string]string  `json:"group,omitempty"`
+	Percentiles map[string]float32 `json:"percentiles"`
+
+	// Windows holds the percentiles of each window size (e.g., 15m), when several of them are calculated at once. The
+	// record's own percentiles are the ones of the first window size.
+	Windows map[string]PercentileDeliveryTime `json:"windows,omitempty"`
+}
+
+// Reasons why an event can be rejected
+const (
+	// RejectionReasonLate is the reason of the events that arrive after their time-bucket was emitted
+	RejectionReasonLate = "late"
+	// RejectionReasonDuplicate is the reason of the events whose translation id was already processed
+	RejectionReasonDuplicate = "duplicate"
+	// RejectionReasonUnknownEvent is the reason of the events whose name isn't a known type of event
+	RejectionReasonUnknownEvent = "unknown_event"
+)
+
+// RejectedEvent is an event that could not be aggregated, along with the reason why
+type RejectedEvent struct {
+	Reason string `json:"reason"`
+	// Event is usually a TranslationDelivered, or the Envelope of an event whose type is unknown
+	Event any `json:"event"`
+}
+
+// ProcessingSummary holds the counts of events handled while aggregating
+type ProcessingSummary struct {
+	ProcessedEvents int `json:"processed_events"`
+	LateEvents      int `json:"late_events"`
+	DuplicateEvents int `json:"duplicate_events"`
+	FilteredEvents  int `json:"filtered_events"`
+	// UnknownEvents are the events whose name isn't a known type of event
+	UnknownEvents int `json:"unknown_events"`
+	// IgnoredEvents are the events of a known type that isn't aggregated
+	IgnoredEvents int `json:"ignored_events"`
+	// OutOfRangeEvents are the events outside the time range being aggregated
+	OutOfRangeEvents int `json:"out_of_range_events"`
 }
@@ -9,24 +9,58 @@ import (
 const (
 	inputTimeLayout  = "2006-01-02 15:04:05.999999"
 	outputTimeLayout = "2006-01-02 15:04:00"
+
+	secondsOutputTimeLayout = "2006-01-02 15:04:05"
+	hoursOutputTimeLayout   = "2006-01-02 15:00:00"
+	daysOutputTimeLayout    = "2006-01-02 00:00:00"
 )
 
 // Time is a custom time type that allows us to marshall and unmarshall with the specific formats expected
 // in the input and output
 type Time struct {
 	time.Time
+	// layout is the output format. If empty, the time is written with a precision of minutes.
+	layout string
+}
+
+// NewTime creates a Time whose output format has the provided precision (e.g., seconds are only written when the
+// precision is smaller than a minute)
+func NewTime(t time.Time, precision time.Duration) Time {
+	var layout string
+	switch {
+	case precision%time.Minute != 0:
+		layout = secondsOutputTimeLayout
+	case precision%(24*time.Hour) == 0:
+		layout = daysOutputTimeLayout
+	case precision%time.Hour == 0:
+		layout = hoursOutputTimeLayout
+	}
+	return Time{Time: t, layout: layout}
 }
 
 func (t Time) MarshalJSON() ([]byte, error) {
-	return json.Marshal(t.Time.Format(outputTimeLayout))
+	layout := t.layout
+	if layout == "" {
+		layout = outputTimeLayout
+	}
+	return json.Marshal(t.Time.Format(layout))
 }
 
 func (t *Time) UnmarshalJSON(data []byte) error {
-	str := strings.Trim(string(data), `"`)
-	parsed, err := time.Parse(inputTimeLayout, str)
+	parsed, err := ParseTime(strings.Trim(string(data), `"`))
 	if err != nil {
 		return err
 	}
-	t.Time = parsed
+	*t = parsed
 	return nil
 }
+
+// ParseTime parses a time in the same format as the timestamps of the input events (e.g., 2018-12-26 18:11:08.509654),
+// where the fractional seconds are optional
+func ParseTime(value string) (Time, error) {
+	parsed, err := time.Parse(inputTimeLayout, value)
+	if err != nil {
+		return Time{}, err
+	}
+	return Time{Time: parsed}, nil
+}
@@ -1,9 +1,57 @@
 package inboundprt
 
 import (
+	"context"
+	"time"
+
 	"github.com/lucaslobo/aggregator/internal/core/domain"
 )
 
+// MovingAverageCalculator aggregates the events. All the methods that may store output or state take a context, which
+// is passed to the storers. Once it's cancelled, they return its error as soon as possible, e.g., in the middle of
+// filling a large gap between events. The state is still valid afterwards, but the event being processed may or may not
+// be part of it.
 type MovingAverageCalculator interface {
-	ProcessEvent(event domain.TranslationDelivered) error
+	ProcessEvent(ctx context.Context, event domain.TranslationDelivered) error
+
+	// ProcessEvents processes the events in order, as ProcessEvent does, but stores the output of all the time-buckets
+	// advanced by the batch at once, so that storers can write in bulk
+	ProcessEvents(ctx context.Context, events []domain.TranslationDelivered) error
+
+	// AdvanceTo calculates the aggregations of all the time-buckets that end before or at the provided time, even if
+	// no events arrived for them
+	AdvanceTo(ctx context.Context, t time.Time) error
+
+	// Flush stores the aggregations of all the time-buckets until the one of the most recent event, as if no more late
+	// events were coming (e.g., at the end of a file). Unlike Finish, the windows aren't emptied. Events that arrive
+	// afterwards for those time-buckets are too late.
+	Flush(ctx context.Context) error
+
+	// Finish stores the aggregations of all the time-buckets until the windows are empty, as if no more events were
+	// coming (e.g., at the end of a file), so that the last events are part of as many aggregations as the others.
+	// Events that arrive afterwards for those time-buckets are too late.
+	Finish(ctx context.Context) error
+
+	// Summary returns the counts of events handled so far
+	Summary() domain.ProcessingSummary
+
+	// Checkpoint stores the state of the aggregation, so that it can be restored after a restart. The offset is the
+	// position of the input (e.g., bytes of a file) up to which the events are part of the state.
+	Checkpoint(ctx context.Context, offset int64) error
+
+	// Restore replaces the state of the aggregation with the last stored checkpoint, if there is one, and returns its
+	// offset
+	Restore(ctx context.Context) (int64, error)
+}
+
+// EventRouter is used by the inbound adapters, which read events of any type
+type EventRouter interface {
+	MovingAverageCalculator
+
+	// Route processes the event according to its name. Events of unknown types are skipped.
+	Route(ctx context.Context, envelope domain.Envelope) error
+
+	// RouteEvents routes the events in order, as Route does, but processes the consecutive translation_delivered events
+	// with a single ProcessEvents call, so that storers can write in bulk
+	RouteEvents(ctx context.Context, envelopes []domain.Envelope) error
 }
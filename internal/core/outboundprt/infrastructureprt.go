@@ -1,16 +1,45 @@
 package outboundprt
 
 import (
+	"context"
+
 	"github.com/lucaslobo/aggregator/internal/core/domain"
 )
 
 type MovingAverageStorer interface {
 	// StoreMovingAverage stores one domain.AverageDeliveryTime
-	StoreMovingAverage(domain.AverageDeliveryTime) error
+	StoreMovingAverage(context.Context, domain.AverageDeliveryTime) error
 
 	// StoreMovingAverageSlice stores a slice of domain.AverageDeliveryTime
-	StoreMovingAverageSlice([]domain.AverageDeliveryTime) error
+	StoreMovingAverageSlice(context.Context, []domain.AverageDeliveryTime) error
 
 	// Close closes the underlying resource/connection of the MovingAverageStorer
 	Close() error
 }
+
+type PercentileStorer interface {
+	// StorePercentiles stores one domain.PercentileDeliveryTime
+	StorePercentiles(context.Context, domain.PercentileDeliveryTime) error
+
+	// StorePercentilesSlice stores a slice of domain.PercentileDeliveryTime
+	StorePercentilesSlice(context.Context, []domain.PercentileDeliveryTime) error
+
+	// Close closes the underlying resource/connection of the PercentileStorer
+	Close() error
+}
+
+type RejectedEventStorer interface {
+	// StoreRejectedEvent stores one domain.RejectedEvent
+	StoreRejectedEvent(context.Context, domain.RejectedEvent) error
+
+	// Close closes the underlying resource/connection of the RejectedEventStorer
+	Close() error
+}
+
+type StateStorer interface {
+	// StoreState stores the state of the aggregation, replacing the previous one
+	StoreState(ctx context.Context, state []byte) error
+
+	// LoadState returns the last stored state, or nil if there is none
+	LoadState(ctx context.Context) ([]byte, error)
+}
@@ -2,9 +2,11 @@ package inbound
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
-	"os"
+	"io"
+	"time"
 
 	"github.com/lucaslobo/aggregator/internal/common/closer"
 	"github.com/lucaslobo/aggregator/internal/common/logs"
@@ -12,42 +14,215 @@ import (
 	"github.com/lucaslobo/aggregator/internal/core/inboundprt"
 )
 
+// Input modes, which identify what the offsets checkpointed by each way of reading the input count
+const (
+	// InputModeFiles is the mode of CalculateMovingAverageFromFiles, whose offsets are bytes of the input files
+	InputModeFiles = "files"
+	// InputModeMerge is the mode of MergeMovingAverageFromFiles, whose offsets are numbers of merged events
+	InputModeMerge = "merge"
+	// InputModeQueue is the mode of the QueueConsumer, whose checkpoints have no offset
+	InputModeQueue = "queue"
+)
+
 type FileProcessor struct {
 	logger logs.Logger
-	svc    inboundprt.MovingAverageCalculator
+	svc    inboundprt.EventRouter
+
+	// checkpointInterval is how often the state of the svc is checkpointed, along with the offset of the file up to
+	// which the events were processed. If 0, there are no checkpoints.
+	checkpointInterval time.Duration
+	// workers is the number of goroutines decoding the lines of the file. If more than 1, the file is processed in a
+	// pipeline (see processPipelined), otherwise each line is read, decoded and processed in turn.
+	workers int
+
+	// drain makes the windows advance at the end of the file until they're empty
+	drain bool
+	// until makes the windows advance at the end of the file until this time, if it's not zero
+	until time.Time
 }
 
-func NewFileProcessor(logger logs.Logger, svc inboundprt.MovingAverageCalculator) FileProcessor {
+func NewFileProcessor(logger logs.Logger, svc inboundprt.EventRouter, checkpointInterval time.Duration, workers int, drain bool, until time.Time) FileProcessor {
 	return FileProcessor{
-		logger: logger,
-		svc:    svc,
+		logger:             logger,
+		svc:                svc,
+		checkpointInterval: checkpointInterval,
+		workers:            workers,
+		drain:              drain,
+		until:              until,
 	}
 }
 
-// CalculateMovingAverageFromFile calculates the moving average for the events stored in the file (relative path).
-func (f FileProcessor) CalculateMovingAverageFromFile(filename string) error {
-	file, err := os.Open(filename)
+// CalculateMovingAverageFromFiles calculates the moving average for the events stored in the files (relative paths, or
+// "-" for the stdin), in the provided order, as if they were a single file, so that the windows carry across files.
+// Compressed files are decompressed as they're read. It starts at the provided byte offset (e.g., the offset of the last
+// checkpoint), which is relative to the beginning of the first file: the files before it are skipped. Once all the
+// files are processed, the windows are drained or advanced until the end time, if configured. If there is a checkpoint
+// interval, the state is then checkpointed.
+//
+// If the ctx is cancelled, it stops between events and returns the ctx error. The state is then checkpointed up to the
+// last processed event, so that the processing can be resumed from there with the same files.
+func (f FileProcessor) CalculateMovingAverageFromFiles(ctx context.Context, filenames []string, offset int64) error {
+	// start is the offset of the beginning of each file, which is the end of the previous one
+	var start int64
+	for _, filename := range filenames {
+		var err error
+		if start, err = f.processFile(ctx, filename, start, offset); err != nil {
+			return err
+		}
+	}
+
+	return f.finish(ctx, max(start, offset))
+}
+
+// processFile processes the events of the file that begins at the start offset, from the provided offset if it's
+// past the start, and returns the offset of its end. The file is skipped if it ends before the offset. Compressed
+// files are decompressed as they're read, and their offsets are offsets of the decompressed events.
+func (f FileProcessor) processFile(ctx context.Context, filename string, start, offset int64) (int64, error) {
+	file, err := openInput(ctx, filename)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return start, f.cancelIfDone(ctx, start, err)
 	}
 	defer closer.Close(f.logger, file)
 
+	if offset > start {
+		skipped, err := file.skip(offset - start)
+		if err != nil {
+			return start, fmt.Errorf("failed to resume %s: %w", filename, err)
+		}
+		if skipped < offset-start {
+			return start + skipped, nil
+		}
+		start = offset
+	}
+
+	f.logger.Infow("processing file",
+		"file", filename,
+		"offset", start)
+
+	if f.workers > 1 {
+		return f.processPipelined(ctx, file, start)
+	}
+	return f.processSerially(ctx, file, start)
+}
+
+// finish stores the aggregations until the time-bucket of the last event, and then until the windows are empty when
+// draining, or until the end time. If there is a checkpoint interval, the state is then checkpointed along with the
+// offset of the end of the input.
+func (f FileProcessor) finish(ctx context.Context, offset int64) error {
+	// the input is over, so no late events are expected for the time-bucket of the last event
+	if err := f.svc.Flush(ctx); err != nil {
+		return fmt.Errorf("could not flush windows: %w", err)
+	}
+	if f.drain {
+		if err := f.svc.Finish(ctx); err != nil {
+			return fmt.Errorf("could not drain windows: %w", err)
+		}
+	}
+	if !f.until.IsZero() {
+		if err := f.svc.AdvanceTo(ctx, f.until); err != nil {
+			return fmt.Errorf("could not advance windows until %s: %w", f.until, err)
+		}
+	}
+
+	if f.checkpointInterval > 0 {
+		if err := f.svc.Checkpoint(ctx, offset); err != nil {
+			return fmt.Errorf("could not checkpoint state: %w", err)
+		}
+	}
+	return nil
+}
+
+// processSerially reads, decodes and processes the lines of the file one at a time, and returns the offset up to which
+// they were processed
+func (f FileProcessor) processSerially(ctx context.Context, file io.Reader, offset int64) (int64, error) {
 	// Let's scan the input file line by line to avoid storing the full file in memory
-	scanner := bufio.NewScanner(file)
+	scanner := newLineScanner(file, &offset)
 
+	// processed is the offset up to which the events are part of the state, while the offset is already past the line
+	// being processed
+	processed := offset
+	lastCheckpoint := time.Now()
 	for scanner.Scan() {
-		line := scanner.Bytes()
-		var event domain.TranslationDelivered
-		if err = json.Unmarshal(line, &event); err != nil {
-			return fmt.Errorf("failed to decode line as JSON: %w", err)
+		if err := ctx.Err(); err != nil {
+			return processed, f.cancel(ctx, processed, err)
 		}
-		if err = f.svc.ProcessEvent(event); err != nil {
-			return fmt.Errorf("error while processing event: %w", err)
+
+		var event domain.Envelope
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return processed, fmt.Errorf("failed to decode line as JSON: %w", err)
 		}
+		if err := f.process(ctx, event, offset, &lastCheckpoint); err != nil {
+			return processed, err
+		}
+		processed = offset
 	}
-	if err = scanner.Err(); err != nil {
-		return fmt.Errorf("error scanning file: %w", err)
+	if err := scanner.Err(); err != nil {
+		return processed, f.cancelIfDone(ctx, processed, fmt.Errorf("error scanning file: %w", err))
 	}
+	return processed, nil
+}
 
+// newLineScanner returns a scanner of the lines of the file, which moves the offset past each line as it's scanned,
+// including its line break
+func newLineScanner(file io.Reader, offset *int64) *bufio.Scanner {
+	scanner := bufio.NewScanner(file)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		*offset += int64(advance)
+		return advance, token, err
+	})
+	return scanner
+}
+
+// process routes the event, and then checkpoints the state along with the offset after its line, if the checkpoint
+// interval has passed since the last one
+func (f FileProcessor) process(ctx context.Context, event domain.Envelope, offset int64, lastCheckpoint *time.Time) error {
+	if err := f.svc.Route(ctx, event); err != nil {
+		return fmt.Errorf("error while processing event: %w", err)
+	}
+	return f.checkpointIfDue(ctx, offset, lastCheckpoint)
+}
+
+// processBatch routes the events at once, and then checkpoints the state along with the offset after the line of the
+// last one, if the checkpoint interval has passed since the last one
+func (f FileProcessor) processBatch(ctx context.Context, events []domain.Envelope, offset int64, lastCheckpoint *time.Time) error {
+	if err := f.svc.RouteEvents(ctx, events); err != nil {
+		return fmt.Errorf("error while processing events: %w", err)
+	}
+	return f.checkpointIfDue(ctx, offset, lastCheckpoint)
+}
+
+// checkpointIfDue checkpoints the state along with the offset, if the checkpoint interval has passed since the last one
+func (f FileProcessor) checkpointIfDue(ctx context.Context, offset int64, lastCheckpoint *time.Time) error {
+	if f.checkpointInterval > 0 && time.Since(*lastCheckpoint) >= f.checkpointInterval {
+		if err := f.svc.Checkpoint(ctx, offset); err != nil {
+			return fmt.Errorf("could not checkpoint state: %w", err)
+		}
+		*lastCheckpoint = time.Now()
+	}
 	return nil
 }
+
+// cancel checkpoints the state up to the offset of the last processed event, and returns the cancellation error. The
+// checkpoint isn't bound to the ctx, since it's already cancelled.
+func (f FileProcessor) cancel(ctx context.Context, offset int64, cause error) error {
+	f.logger.Infow("processing cancelled",
+		"offset", offset,
+		"summary", f.svc.Summary())
+
+	if f.checkpointInterval > 0 {
+		if err := f.svc.Checkpoint(context.WithoutCancel(ctx), offset); err != nil {
+			return fmt.Errorf("could not checkpoint state: %w", err)
+		}
+	}
+	return fmt.Errorf("processing cancelled at offset %d: %w", offset, cause)
+}
+
+// cancelIfDone cancels the processing at the offset if the ctx is done, since a read waiting for data (e.g., from an
+// idle stdin) then fails with the ctx error. Otherwise, it returns the error of the read.
+func (f FileProcessor) cancelIfDone(ctx context.Context, offset int64, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return f.cancel(ctx, offset, ctxErr)
+	}
+	return err
+}
@@ -0,0 +1,271 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/lucaslobo/aggregator/internal/common/logs"
+	"github.com/lucaslobo/aggregator/internal/core/application"
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+	"github.com/lucaslobo/aggregator/internal/core/inboundprt"
+	"github.com/lucaslobo/aggregator/internal/outbound"
+)
+
+// mockRouter records the ids of the routed events, and how many times the windows were flushed. The other methods of
+// the EventRouter are not used.
+type mockRouter struct {
+	inboundprt.EventRouter
+	routed  []string
+	flushes int
+}
+
+func (m *mockRouter) Route(_ context.Context, envelope domain.Envelope) error {
+	event, err := envelope.Decode()
+	if err != nil {
+		return err
+	}
+	m.routed = append(m.routed, event.(domain.TranslationDelivered).TranslationId)
+	return nil
+}
+
+func (m *mockRouter) Flush(context.Context) error {
+	m.flushes++
+	return nil
+}
+
+func (m *mockRouter) Summary() domain.ProcessingSummary {
+	return domain.ProcessingSummary{ProcessedEvents: len(m.routed)}
+}
+
+func TestMergeMovingAverageFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	// each event is the time of its timestamp and its id
+	files := map[string][][2]string{
+		"eu.json": {{"18:11:00", "eu1"}, {"18:13:00", "eu2"}, {"18:15:00", "eu3"}},
+		"us.json": {{"18:10:00", "us1"}, {"18:13:00", "us2"}, {"18:20:00", "us3"}},
+		// files without events are merged as well
+		"empty.json": {},
+	}
+	for name, events := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), eventLines(events), 0o644))
+	}
+	logger := logs.Logger{SugaredLogger: zap.NewNop().Sugar()}
+	filenames := []string{filepath.Join(dir, "empty.json"), filepath.Join(dir, "eu.json"), filepath.Join(dir, "us.json")}
+
+	// the events with the same timestamp are merged in the order of the files
+	router := &mockRouter{}
+	err := NewFileProcessor(logger, router, 0, 1, false, time.Time{}).MergeMovingAverageFromFiles(t.Context(), filenames, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"us1", "eu1", "eu2", "us2", "eu3", "us3"}, router.routed)
+	// the time-bucket of the last event is stored once the files are over
+	assert.Equal(t, 1, router.flushes)
+
+	// the events up to the offset were already processed
+	router = &mockRouter{}
+	err = NewFileProcessor(logger, router, 0, 1, false, time.Time{}).MergeMovingAverageFromFiles(t.Context(), filenames, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eu3", "us3"}, router.routed)
+}
+
+func TestCalculateMovingAverageFromFiles_Compressed(t *testing.T) {
+	dir := t.TempDir()
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	_, err := gz.Write(eventLines([][2]string{{"18:10:00", "gz1"}, {"18:11:00", "gz2"}}))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	zstded := encoder.EncodeAll(eventLines([][2]string{{"18:12:00", "zs1"}, {"18:13:00", "zs2"}}), nil)
+
+	// the zstd file is detected by its first bytes, since it has no extension
+	filenames := []string{filepath.Join(dir, "events.json.gz"), filepath.Join(dir, "events")}
+	require.NoError(t, os.WriteFile(filenames[0], gzipped.Bytes(), 0o644))
+	require.NoError(t, os.WriteFile(filenames[1], zstded, 0o644))
+	logger := logs.Logger{SugaredLogger: zap.NewNop().Sugar()}
+
+	router := &mockRouter{}
+	err = NewFileProcessor(logger, router, 0, 1, false, time.Time{}).CalculateMovingAverageFromFiles(t.Context(), filenames, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gz1", "gz2", "zs1", "zs2"}, router.routed)
+
+	// the offset is counted over the decompressed events, and the first file ends after the first line of the second
+	line := int64(len(eventLines([][2]string{{"18:10:00", "gz1"}})))
+	router = &mockRouter{}
+	err = NewFileProcessor(logger, router, 0, 1, false, time.Time{}).CalculateMovingAverageFromFiles(t.Context(), filenames, 3*line)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"zs2"}, router.routed)
+}
+
+func TestCalculateMovingAverageFromFiles_Stdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	_, err = w.Write(eventLines([][2]string{{"18:10:00", "in1"}, {"18:11:00", "in2"}}))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		_ = r.Close()
+	})
+
+	router := &mockRouter{}
+	err = NewFileProcessor(logs.Logger{SugaredLogger: zap.NewNop().Sugar()}, router, 0, 1, false, time.Time{}).
+		CalculateMovingAverageFromFiles(t.Context(), []string{stdinFilename}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"in1", "in2"}, router.routed)
+
+	// the stdin is left open, since it belongs to the whole process
+	_, err = os.Stdin.Stat()
+	assert.NoError(t, err)
+}
+
+func TestCalculateMovingAverageFromFiles_StdinCancelled(t *testing.T) {
+	logger := logs.Logger{SugaredLogger: zap.NewNop().Sugar()}
+	tests := []struct {
+		name    string
+		process func(ctx context.Context, router *mockRouter) error
+	}{
+		{name: "serially", process: func(ctx context.Context, router *mockRouter) error {
+			return NewFileProcessor(logger, router, 0, 1, false, time.Time{}).CalculateMovingAverageFromFiles(ctx, []string{stdinFilename}, 0)
+		}},
+		{name: "pipelined", process: func(ctx context.Context, router *mockRouter) error {
+			return NewFileProcessor(logger, router, 0, 4, false, time.Time{}).CalculateMovingAverageFromFiles(ctx, []string{stdinFilename}, 0)
+		}},
+		{name: "merged", process: func(ctx context.Context, router *mockRouter) error {
+			return NewFileProcessor(logger, router, 0, 1, false, time.Time{}).MergeMovingAverageFromFiles(ctx, []string{stdinFilename}, 0)
+		}},
+	}
+
+	for _, tc := range tests {
+		// the stdin is idle either from the start, when the first bytes are peeked to detect the compression, or after
+		// the first event
+		for _, events := range [][][2]string{nil, {{"18:10:00", "in1"}}} {
+			t.Run(fmt.Sprintf("%s with %d events", tc.name, len(events)), func(t *testing.T) {
+				// the writer is left open without writing anything else
+				r, w, err := os.Pipe()
+				require.NoError(t, err)
+				_, err = w.Write(eventLines(events))
+				require.NoError(t, err)
+				stdin := os.Stdin
+				os.Stdin = r
+				t.Cleanup(func() {
+					os.Stdin = stdin
+					_ = w.Close()
+					_ = r.Close()
+				})
+
+				ctx, cancel := context.WithCancel(t.Context())
+				done := make(chan error, 1)
+				go func() {
+					done <- tc.process(ctx, &mockRouter{})
+				}()
+				time.Sleep(10 * time.Millisecond)
+				cancel()
+
+				select {
+				case err = <-done:
+					assert.ErrorIs(t, err, context.Canceled)
+				case <-time.After(5 * time.Second):
+					require.FailNow(t, "the processing wasn't cancelled while waiting for the stdin")
+				}
+			})
+		}
+	}
+}
+
+// eventLines returns the input lines of the events, each one with the time of its timestamp and its id
+func eventLines(events [][2]string) []byte {
+	var lines []byte
+	for _, event := range events {
+		lines = fmt.Appendf(lines, `{"timestamp": "2018-12-26 %s.000000", "translation_id": "%s", "event_name": "translation_delivered"}`+"\n", event[0], event[1])
+	}
+	return lines
+}
+
+// BenchmarkCalculateMovingAverageFromFiles measures the throughput of processing a file serially and in a pipeline, with
+// the output written to files. Run it with: go test -bench CalculateMovingAverageFromFiles ./internal/inbound/
+func BenchmarkCalculateMovingAverageFromFiles(b *testing.B) {
+	input := writeEvents(b, 100_000)
+	info, err := os.Stat(input)
+	if err != nil {
+		b.Fatal(err)
+	}
+	logger := logs.Logger{SugaredLogger: zap.NewNop().Sugar()}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(info.Size())
+			for b.Loop() {
+				var storer outbound.OutputStorer = outbound.NewFileWriter(logger, b.TempDir())
+				if workers > 1 {
+					storer = outbound.NewAsyncStorer(storer, nil, 1024)
+				}
+				cfg := application.Config{
+					WindowSizes:     []int{5, 15, 60},
+					GroupBy:         []string{"client_name"},
+					AllowedLateness: time.Minute,
+					RejectedStorer:  storer,
+				}
+				svc := application.NewRouter(cfg, application.New(cfg, storer))
+
+				err := NewFileProcessor(logger, svc, 0, workers, false, time.Time{}).CalculateMovingAverageFromFiles(b.Context(), []string{input}, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err = storer.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// writeEvents writes a file with the provided number of events, a few seconds apart, and returns its path
+func writeEvents(b *testing.B, events int) string {
+	path := filepath.Join(b.TempDir(), "events.json")
+	file, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	encoder := json.NewEncoder(w)
+	clients := []string{"airliberty", "taxi-eats", "easyjet"}
+	timestamp := time.Date(2018, 12, 26, 18, 0, 0, 0, time.UTC)
+	for i := range events {
+		timestamp = timestamp.Add(time.Duration(i%7) * time.Second)
+		err = encoder.Encode(domain.TranslationDelivered{
+			Timestamp:      domain.Time{Time: timestamp},
+			TranslationId:  fmt.Sprintf("%020x", i),
+			SourceLanguage: "en",
+			TargetLanguage: "fr",
+			ClientName:     clients[i%len(clients)],
+			EventName:      domain.EventNameTranslationDelivered,
+			NrWords:        10 + i%90,
+			Duration:       20 + i%40,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
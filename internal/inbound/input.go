@@ -0,0 +1,209 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// stdinFilename is the name of the input file that reads the events from the stdin
+const stdinFilename = "-"
+
+// compression is a format of compressed input files, which are identified by their extension or their first bytes
+type compression struct {
+	name      string
+	extension string
+	magic     []byte
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// compressions lists the formats of compressed input files that are decompressed as they're read
+var compressions = []compression{
+	{
+		name:      "gzip",
+		extension: ".gz",
+		magic:     []byte{0x1f, 0x8b},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		name:      "zstd",
+		extension: ".zst",
+		magic:     []byte{0x28, 0xb5, 0x2f, 0xfd},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+	{
+		name:      "bzip2",
+		extension: ".bz2",
+		magic:     []byte("BZh"),
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(r)), nil
+		},
+	},
+}
+
+// input is an input file opened for reading, whose events are decompressed as they're read if it's compressed.
+// Offsets in the input are offsets of the decompressed events.
+type input struct {
+	io.Reader
+	file *os.File
+	// closer closes the file, unless it's the stdin, which is left open for the rest of the process
+	closer io.Closer
+	// interruptible reads the file if its reads can wait for data (e.g., the stdin when it's a pipe), otherwise it's nil
+	interruptible *ctxReader
+	buffered      *bufio.Reader
+	// decompressor is nil if the file isn't compressed
+	decompressor io.ReadCloser
+}
+
+// openInput opens the file, or the stdin if the filename is "-". If the file has the extension or the first bytes of
+// one of the compressions, it's decompressed as it's read. If the file isn't a regular one, its reads return the ctx
+// error as soon as the ctx is cancelled, even while they wait for data (e.g., from an idle stdin).
+func openInput(ctx context.Context, filename string) (*input, error) {
+	file := os.Stdin
+	var closer io.Closer = io.NopCloser(file)
+	if filename != stdinFilename {
+		var err error
+		if file, err = os.Open(filename); err != nil {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+		closer = file
+	}
+
+	// the first bytes are peeked, so that they're still read afterward (e.g., when reading from the stdin)
+	in := &input{file: file, closer: closer}
+	if info, err := file.Stat(); err != nil || !info.Mode().IsRegular() {
+		in.interruptible = &ctxReader{ctx: ctx, r: file, buf: make([]byte, ctxReaderBufferSize), reads: make(chan ctxRead, 1)}
+		in.buffered = bufio.NewReader(in.interruptible)
+	} else {
+		in.buffered = bufio.NewReader(file)
+	}
+	in.Reader = in.buffered
+	magic, err := in.buffered.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		_ = closer.Close()
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	for _, c := range compressions {
+		if filepath.Ext(filename) != c.extension && !bytes.HasPrefix(magic, c.magic) {
+			continue
+		}
+		if in.decompressor, err = c.newReader(in.buffered); err != nil {
+			_ = closer.Close()
+			return nil, fmt.Errorf("failed to decompress %s file: %w", c.name, err)
+		}
+		in.Reader = in.decompressor
+		break
+	}
+	return in, nil
+}
+
+// skip moves the input n bytes forward, and returns the number of bytes skipped, which is less than n if the input ends
+// before. Regular files that aren't compressed seek the offset, while the others must be read until it.
+func (in *input) skip(n int64) (int64, error) {
+	info, err := in.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	if in.decompressor == nil && info.Mode().IsRegular() {
+		n = min(n, info.Size())
+		if _, err = in.file.Seek(n, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("failed to seek offset %d: %w", n, err)
+		}
+		// the bytes peeked before seeking are discarded
+		in.buffered.Reset(in.file)
+		return n, nil
+	}
+
+	skipped, err := io.CopyN(io.Discard, in, n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return skipped, fmt.Errorf("failed to skip %d bytes: %w", n, err)
+	}
+	return skipped, nil
+}
+
+// watch makes the reads that wait for data return as soon as the provided ctx is cancelled, instead of the one the input
+// was opened with (e.g., to stop a goroutine reading it). It must not be called while reading. Regular files never
+// wait for data, so it does nothing for them.
+func (in *input) watch(ctx context.Context) {
+	if in.interruptible != nil {
+		in.interruptible.ctx = ctx
+	}
+}
+
+// ctxReaderBufferSize is the size of the reads of a ctxReader, which are then copied to the callers' buffers
+const ctxReaderBufferSize = 64 * 1024
+
+// ctxReader reads from r in a separate goroutine, so that a read waiting for data can be abandoned when the ctx is
+// cancelled. The abandoned read is left pending, and its data is returned by the next read, if any.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+
+	buf []byte
+	// reads receives the result of the pending read into buf, if there is one
+	reads   chan ctxRead
+	pending bool
+	// data is the part of buf that was read but not returned yet, and err the error of the read, returned after it
+	data []byte
+	err  error
+}
+
+type ctxRead struct {
+	n   int
+	err error
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if len(cr.data) == 0 && cr.err == nil {
+		if !cr.pending {
+			cr.pending = true
+			go func() {
+				n, err := cr.r.Read(cr.buf)
+				cr.reads <- ctxRead{n: n, err: err}
+			}()
+		}
+		select {
+		case read := <-cr.reads:
+			cr.pending = false
+			cr.data, cr.err = cr.buf[:read.n], read.err
+		case <-cr.ctx.Done():
+			return 0, cr.ctx.Err()
+		}
+	}
+
+	n := copy(p, cr.data)
+	cr.data = cr.data[n:]
+	if len(cr.data) == 0 {
+		return n, cr.err
+	}
+	return n, nil
+}
+
+func (in *input) Close() error {
+	if in.decompressor != nil {
+		if err := in.decompressor.Close(); err != nil {
+			_ = in.closer.Close()
+			return err
+		}
+	}
+	return in.closer.Close()
+}
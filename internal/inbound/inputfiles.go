@@ -0,0 +1,158 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Orders in which the input files are processed
+const (
+	// OrderByName processes the files in the lexicographic order of their paths (e.g., 2018/12/26/18.json before
+	// 2018/12/26/19.json)
+	OrderByName = "name"
+	// OrderByTimestamp processes the files in the order of the timestamp of their first event
+	OrderByTimestamp = "timestamp"
+)
+
+// AvailableOrders lists the orders in which the input files can be processed
+var AvailableOrders = []string{OrderByName, OrderByTimestamp}
+
+// ListInputFiles returns the files matched by the paths, in the provided order. Each path can be a file, a glob pattern
+// (e.g., data/*.json) or a directory, whose files are listed recursively, except for the hidden ones. As in a shell, glob
+// patterns only match hidden files if they start with a dot as well. Each file is only listed once, even if it's matched
+// by several paths. It returns an error if a path doesn't match any file.
+//
+// The path "-" is the stdin, which can't be read along with other files.
+func ListInputFiles(paths []string, order string) ([]string, error) {
+	if slices.Contains(paths, stdinFilename) {
+		if len(paths) > 1 {
+			return nil, fmt.Errorf("the stdin (%s) can't be read along with other input files", stdinFilename)
+		}
+		return paths, nil
+	}
+
+	var files []string
+	for _, path := range paths {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input path %q: %w", path, err)
+		}
+
+		var found []string
+		for _, match := range matches {
+			if isHidden(match) && !isHidden(path) {
+				continue
+			}
+			listed, err := listFiles(match)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, listed...)
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("no input files found in %q", path)
+		}
+		files = append(files, found...)
+	}
+
+	slices.Sort(files)
+	files = slices.Compact(files)
+
+	switch order {
+	case OrderByName:
+		return files, nil
+	case OrderByTimestamp:
+		return sortByFirstTimestamp(files)
+	default:
+		return nil, fmt.Errorf("invalid order %q, must be one of %v", order, AvailableOrders)
+	}
+}
+
+// listFiles returns the path if it's a file, or the files in it, recursively, if it's a directory
+func listFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat input path: %w", err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		hidden := name != path && isHidden(name)
+		if entry.IsDir() {
+			if hidden {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !hidden && entry.Type().IsRegular() {
+			files = append(files, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list input directory: %w", err)
+	}
+	return files, nil
+}
+
+// isHidden returns true if the last element of the path starts with a dot (e.g., .git)
+func isHidden(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// sortByFirstTimestamp sorts the files by the timestamp of their first event. The files without events are sorted
+// first, and the files whose first events have the same timestamp are kept in the order of their paths.
+func sortByFirstTimestamp(files []string) ([]string, error) {
+	first := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		timestamp, err := firstTimestamp(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read first event of %s: %w", file, err)
+		}
+		first[file] = timestamp
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return first[files[i]].Before(first[files[j]])
+	})
+	return files, nil
+}
+
+// firstTimestamp returns the timestamp of the first event of the file, or the zero time if it has no events
+func firstTimestamp(filename string) (time.Time, error) {
+	// the stdin is never sorted, so the files can't wait for data
+	file, err := openInput(context.Background(), filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		timestamp, err := decodeTimestamp(line)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to decode line as JSON: %w", err)
+		}
+		return timestamp, nil
+	}
+	return time.Time{}, scanner.Err()
+}
@@ -0,0 +1,138 @@
+package inbound
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListInputFiles(t *testing.T) {
+	dir := t.TempDir()
+	// each file has the events with the provided times, so that their order by timestamp differs from their names
+	files := map[string][][2]string{
+		"archive/18.json":        {{"18:10:00", "a1"}, {"18:20:00", "a2"}},
+		"archive/19.json":        {{"18:05:00", "b1"}},
+		"archive/nested/20.json": {{"18:30:00", "c1"}},
+		"archive/.partial.json":  {{"18:00:00", "d1"}},
+		"archive/.tmp/21.json":   {{"18:00:00", "e1"}},
+		"archive/empty.json":     {},
+		"late.json":              {{"18:01:00", "f1"}},
+	}
+	for name, events := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, eventLines(events), 0o644))
+	}
+
+	tests := []struct {
+		name     string
+		paths    []string
+		order    string
+		expected []string
+		err      string
+	}{
+		{
+			name:     "file",
+			paths:    []string{"late.json"},
+			order:    OrderByName,
+			expected: []string{"late.json"},
+		},
+		{
+			name:     "glob",
+			paths:    []string{"archive/*.json"},
+			order:    OrderByName,
+			expected: []string{"archive/18.json", "archive/19.json", "archive/empty.json"},
+		},
+		{
+			name:     "glob without the hidden files",
+			paths:    []string{"archive/*"},
+			order:    OrderByName,
+			expected: []string{"archive/18.json", "archive/19.json", "archive/empty.json", "archive/nested/20.json"},
+		},
+		{
+			name:     "hidden files matched explicitly",
+			paths:    []string{"archive/.*.json", "archive/.tmp"},
+			order:    OrderByName,
+			expected: []string{"archive/.partial.json", "archive/.tmp/21.json"},
+		},
+		{
+			name:     "directory without the hidden files",
+			paths:    []string{"archive"},
+			order:    OrderByName,
+			expected: []string{"archive/18.json", "archive/19.json", "archive/empty.json", "archive/nested/20.json"},
+		},
+		{
+			name:     "files matched by several paths are listed once",
+			paths:    []string{"archive/nested", "archive/nested/20.json", "archive/*/20.json"},
+			order:    OrderByName,
+			expected: []string{"archive/nested/20.json"},
+		},
+		{
+			name:     "all the files are sorted by name, regardless of the order of the paths",
+			paths:    []string{"late.json", "archive/1*.json"},
+			order:    OrderByName,
+			expected: []string{"archive/18.json", "archive/19.json", "late.json"},
+		},
+		{
+			name:     "timestamp",
+			paths:    []string{"archive", "late.json"},
+			order:    OrderByTimestamp,
+			expected: []string{"archive/empty.json", "late.json", "archive/19.json", "archive/18.json", "archive/nested/20.json"},
+		},
+		{
+			name:  "no input files found",
+			paths: []string{"archive", "missing/*.json"},
+			order: OrderByName,
+			err:   "no input files found",
+		},
+		{
+			name:  "invalid order",
+			paths: []string{"archive"},
+			order: "size",
+			err:   "invalid order",
+		},
+		{
+			name:     "stdin",
+			paths:    []string{stdinFilename},
+			order:    OrderByName,
+			expected: []string{stdinFilename},
+		},
+		{
+			name:  "stdin along with other files",
+			paths: []string{stdinFilename, "late.json"},
+			order: OrderByName,
+			err:   "can't be read along with other input files",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			paths := make([]string, len(tc.paths))
+			for i, path := range tc.paths {
+				if path != stdinFilename {
+					path = filepath.Join(dir, path)
+				}
+				paths[i] = path
+			}
+
+			listed, err := ListInputFiles(paths, tc.order)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+
+			expected := make([]string, len(tc.expected))
+			for i, path := range tc.expected {
+				if path != stdinFilename {
+					path = filepath.Join(dir, path)
+				}
+				expected[i] = path
+			}
+			assert.Equal(t, expected, listed)
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package inbound
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lucaslobo/aggregator/internal/common/closer"
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+)
+
+// MergeMovingAverageFromFiles calculates the moving average for the events stored in the files (relative paths), in the
+// order of their timestamps, e.g., when each region dumps its own file. Each file must be ordered by timestamp: they're
+// merged as they're read, so only the next event of each file is kept in memory. The events with the same timestamp
+// are processed in the order of the files.
+//
+// The offset is the number of events that were already processed (e.g., up to the last checkpoint), which are read
+// again but skipped. Once all the files are processed, the windows are drained or advanced until the end time, if
+// configured, and the state is checkpointed, like CalculateMovingAverageFromFiles does.
+func (f FileProcessor) MergeMovingAverageFromFiles(ctx context.Context, filenames []string, offset int64) error {
+	files := make(mergeHeap, 0, len(filenames))
+	for i, filename := range filenames {
+		file, err := openInput(ctx, filename)
+		if err != nil {
+			return f.cancelIfDone(ctx, offset, err)
+		}
+		defer closer.Close(f.logger, file)
+
+		m := &mergedFile{name: filename, index: i, scanner: bufio.NewScanner(file)}
+		ok, err := m.next()
+		if err != nil {
+			return f.cancelIfDone(ctx, offset, err)
+		}
+		if ok {
+			files = append(files, m)
+		}
+	}
+	heap.Init(&files)
+
+	// processed is the number of merged events that are part of the state
+	var processed int64
+	lastCheckpoint := time.Now()
+	for files.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return f.cancel(ctx, max(processed, offset), err)
+		}
+
+		// the file with the earliest event moves on to its next one, and is removed once it has no more events
+		m := files[0]
+		event := m.event
+		ok, err := m.next()
+		if err != nil {
+			return f.cancelIfDone(ctx, max(processed, offset), err)
+		}
+		if ok {
+			heap.Fix(&files, 0)
+		} else {
+			heap.Pop(&files)
+		}
+
+		processed++
+		if processed <= offset {
+			continue
+		}
+		if err = f.process(ctx, event, processed, &lastCheckpoint); err != nil {
+			return err
+		}
+	}
+
+	return f.finish(ctx, max(processed, offset))
+}
+
+// mergedFile is one of the files being merged, along with its next event
+type mergedFile struct {
+	name string
+	// index is the position of the file in the provided order, which orders the events with the same timestamp
+	index   int
+	scanner *bufio.Scanner
+
+	event     domain.Envelope
+	timestamp time.Time
+}
+
+// next reads the next event of the file. It returns false if there are no more events.
+func (m *mergedFile) next() (bool, error) {
+	if !m.scanner.Scan() {
+		if err := m.scanner.Err(); err != nil {
+			return false, fmt.Errorf("error scanning file %s: %w", m.name, err)
+		}
+		return false, nil
+	}
+
+	line := m.scanner.Bytes()
+	m.event = domain.Envelope{}
+	err := json.Unmarshal(line, &m.event)
+	if err == nil {
+		m.timestamp, err = m.event.Timestamp()
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to decode line of %s as JSON: %w", m.name, err)
+	}
+	return true, nil
+}
+
+// mergeHeap implements heap.Interface, with the file whose next event is the earliest at the top
+type mergeHeap []*mergedFile
+
+func (h mergeHeap) Len() int {
+	return len(h)
+}
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].timestamp.Equal(h[j].timestamp) {
+		return h[i].index < h[j].index
+	}
+	return h[i].timestamp.Before(h[j].timestamp)
+}
+
+func (h mergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	*h = append(*h, x.(*mergedFile))
+}
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// decodeTimestamp decodes the timestamp of the event in the line, which can be of any type
+func decodeTimestamp(line []byte) (time.Time, error) {
+	var event struct {
+		Timestamp domain.Time `json:"timestamp"`
+	}
+	err := json.Unmarshal(line, &event)
+	return event.Timestamp.Time, err
+}
@@ -0,0 +1,159 @@
+package inbound
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+)
+
+// chunkSize is the number of lines read and decoded at once by the pipeline, so that the goroutines don't need to
+// synchronize for every line
+const chunkSize = 256
+
+// chunk holds consecutive lines of the file, which are decoded by one of the workers
+type chunk struct {
+	lines [][]byte
+	// offsets holds the offset of the file after each line
+	offsets []int64
+
+	events []domain.Envelope
+	// err is the error decoding the line after the last event, if any
+	err error
+	// decoded is closed once the events are decoded
+	decoded chan struct{}
+}
+
+func (c *chunk) decode() {
+	defer close(c.decoded)
+
+	c.events = make([]domain.Envelope, 0, len(c.lines))
+	for _, line := range c.lines {
+		var event domain.Envelope
+		if c.err = json.Unmarshal(line, &event); c.err != nil {
+			return
+		}
+		event.Predecode()
+		c.events = append(c.events, event)
+	}
+}
+
+// processPipelined processes the lines of the file in a pipeline, and returns the offset up to which they were
+// processed:
+//
+//  1. a reader goroutine reads the lines in chunks
+//  2. the workers decode the chunks concurrently
+//  3. the chunks are processed by the svc (in the calling goroutine) in the order they were read, each one with a
+//     single RouteEvents call, so that their output is stored in bulk. The state is only checkpointed between chunks.
+//
+// The channels between the stages are bounded, so the reader waits for the slowest stage (backpressure), and at most a
+// couple of chunks per worker are kept in memory. The output can be written by yet another goroutine, e.g., with an
+// outbound.AsyncStorer.
+func (f FileProcessor) processPipelined(ctx context.Context, file *input, offset int64) (int64, error) {
+	// the reader and the workers stop as soon as the processing does (e.g., on an error)
+	pipelineCtx, stop := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer stop()
+
+	// the processing order is the order in which the chunks are read, regardless of when they're decoded
+	ordered := make(chan *chunk, 2*f.workers)
+	decoding := make(chan *chunk, f.workers)
+
+	// the reader must not be left waiting for data once the processing stops
+	file.watch(pipelineCtx)
+	var readErr error
+	wg.Go(func() {
+		defer close(ordered)
+		defer close(decoding)
+		readErr = f.read(pipelineCtx, file, offset, ordered, decoding)
+	})
+	for range f.workers {
+		wg.Go(func() {
+			for c := range decoding {
+				c.decode()
+			}
+		})
+	}
+
+	processed := offset
+	lastCheckpoint := time.Now()
+	for c := range ordered {
+		select {
+		case <-c.decoded:
+		case <-ctx.Done():
+			return processed, f.cancel(ctx, processed, ctx.Err())
+		}
+
+		if err := ctx.Err(); err != nil {
+			return processed, f.cancel(ctx, processed, err)
+		}
+		// the events decoded before an error are still processed, as when the file is processed serially
+		if len(c.events) > 0 {
+			last := c.offsets[len(c.events)-1]
+			if err := f.processBatch(ctx, c.events, last, &lastCheckpoint); err != nil {
+				return processed, err
+			}
+			processed = last
+		}
+		if c.err != nil {
+			return processed, fmt.Errorf("failed to decode line as JSON: %w", c.err)
+		}
+	}
+
+	// the reader is done once the ordered channel is closed
+	if readErr != nil {
+		return processed, f.cancelIfDone(ctx, processed, fmt.Errorf("error scanning file: %w", readErr))
+	}
+	return processed, nil
+}
+
+// read reads the lines of the file in chunks, and sends each one to be decoded and processed, until the end of the file
+// or the ctx is cancelled
+func (f FileProcessor) read(ctx context.Context, file io.Reader, offset int64, ordered, decoding chan<- *chunk) error {
+	scanner := newLineScanner(file, &offset)
+
+	send := func(c *chunk) bool {
+		// the chunk is queued to be processed in order, and to be decoded by any of the workers
+		for _, ch := range []chan<- *chunk{ordered, decoding} {
+			select {
+			case ch <- c:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		return true
+	}
+
+	c := newChunk()
+	for scanner.Scan() {
+		// the scanner reuses its buffer, so the line must be copied
+		c.lines = append(c.lines, append([]byte(nil), scanner.Bytes()...))
+		c.offsets = append(c.offsets, offset)
+		if len(c.lines) < chunkSize {
+			continue
+		}
+
+		if !send(c) {
+			return nil
+		}
+		c = newChunk()
+	}
+	// the lines read before an error are still processed, as when the file is processed serially
+	if len(c.lines) > 0 {
+		send(c)
+	}
+	return scanner.Err()
+}
+
+func newChunk() *chunk {
+	return &chunk{
+		lines:   make([][]byte, 0, chunkSize),
+		offsets: make([]int64, 0, chunkSize),
+		decoded: make(chan struct{}),
+	}
+}
@@ -0,0 +1,147 @@
+package inbound
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/lucaslobo/aggregator/internal/common/logs"
+	"github.com/lucaslobo/aggregator/internal/core/application"
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+	"github.com/lucaslobo/aggregator/internal/core/inboundprt"
+)
+
+// recordingRouter wraps an EventRouter, and records the events it routes (as JSON), along with the offset of each
+// checkpoint and the number of events routed before it
+type recordingRouter struct {
+	inboundprt.EventRouter
+	routed      []string
+	checkpoints [][2]int64
+}
+
+func (r *recordingRouter) Route(ctx context.Context, envelope domain.Envelope) error {
+	r.record(envelope)
+	return r.EventRouter.Route(ctx, envelope)
+}
+
+func (r *recordingRouter) RouteEvents(ctx context.Context, envelopes []domain.Envelope) error {
+	for _, envelope := range envelopes {
+		r.record(envelope)
+	}
+	return r.EventRouter.RouteEvents(ctx, envelopes)
+}
+
+func (r *recordingRouter) record(envelope domain.Envelope) {
+	data, _ := json.Marshal(envelope)
+	r.routed = append(r.routed, string(data))
+}
+
+func (r *recordingRouter) Checkpoint(ctx context.Context, offset int64) error {
+	r.checkpoints = append(r.checkpoints, [2]int64{offset, int64(len(r.routed))})
+	return r.EventRouter.Checkpoint(ctx, offset)
+}
+
+// memoryStorer keeps the stored moving averages in memory
+type memoryStorer struct {
+	stored []domain.AverageDeliveryTime
+}
+
+func (m *memoryStorer) StoreMovingAverage(_ context.Context, adt domain.AverageDeliveryTime) error {
+	m.stored = append(m.stored, adt)
+	return nil
+}
+
+func (m *memoryStorer) StoreMovingAverageSlice(_ context.Context, adts []domain.AverageDeliveryTime) error {
+	m.stored = append(m.stored, adts...)
+	return nil
+}
+
+func (m *memoryStorer) Close() error {
+	return nil
+}
+
+func TestProcessPipelined(t *testing.T) {
+	// the events span a few chunks, with events of other types among them
+	var lines []string
+	for i := range 3*chunkSize + 10 {
+		name := domain.EventNameTranslationDelivered
+		if i%50 == 0 {
+			name = "translation_archived"
+		}
+		timestamp := time.Date(2018, 12, 26, 18, 0, 0, 0, time.UTC).Add(time.Duration(i) * 2 * time.Second)
+		lines = append(lines, fmt.Sprintf(`{"timestamp": "%s", "translation_id": "%04d", "event_name": "%s", "client_name": "client-%d", "duration": %d}`,
+			timestamp.Format("2006-01-02 15:04:05.000000"), i, name, i%3, i%50))
+	}
+
+	tests := []struct {
+		name string
+		// invalid is the index of the line that can't be decoded, or -1 if there is none
+		invalid int
+	}{
+		{name: "valid", invalid: -1},
+		{name: "decode error in the middle of a chunk", invalid: chunkSize + chunkSize/2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var content []byte
+			// ends holds the offset of the end of each line
+			var ends []int64
+			for i, line := range lines {
+				if i == tc.invalid {
+					line = `{"timestamp": "2018-12-26 18:00:00.000000", "translation_id": `
+				}
+				content = append(content, line+"\n"...)
+				ends = append(ends, int64(len(content)))
+			}
+			filename := filepath.Join(t.TempDir(), "events.json")
+			require.NoError(t, os.WriteFile(filename, content, 0o644))
+
+			process := func(workers int) (*recordingRouter, *memoryStorer, error) {
+				storer := &memoryStorer{}
+				cfg := application.Config{WindowSize: 5, GroupBy: []string{domain.DimensionClientName}}
+				router := &recordingRouter{EventRouter: application.NewRouter(cfg, application.New(cfg, storer))}
+				// the state is checkpointed after every event or chunk
+				err := NewFileProcessor(logs.Logger{SugaredLogger: zap.NewNop().Sugar()}, router, time.Nanosecond, workers, false, time.Time{}).
+					CalculateMovingAverageFromFiles(t.Context(), []string{filename}, 0)
+				return router, storer, err
+			}
+
+			serialRouter, serialStorer, serialErr := process(1)
+			pipelinedRouter, pipelinedStorer, pipelinedErr := process(4)
+
+			if tc.invalid >= 0 {
+				require.ErrorContains(t, serialErr, "failed to decode line as JSON")
+				require.ErrorContains(t, pipelinedErr, "failed to decode line as JSON")
+				require.Len(t, serialRouter.routed, tc.invalid)
+			} else {
+				require.NoError(t, serialErr)
+				require.NoError(t, pipelinedErr)
+				require.Len(t, serialRouter.routed, len(lines))
+			}
+
+			// the events are routed in the same order, so the output is the same
+			assert.Equal(t, serialRouter.routed, pipelinedRouter.routed)
+			assert.Equal(t, serialStorer.stored, pipelinedStorer.stored)
+
+			// the pipeline only checkpoints between chunks, but the offset of each checkpoint is always the end of the
+			// last event routed before it, and the last one is the same as when processing serially
+			require.NotEmpty(t, pipelinedRouter.checkpoints)
+			for _, router := range []*recordingRouter{serialRouter, pipelinedRouter} {
+				for _, checkpoint := range router.checkpoints {
+					assert.Equal(t, ends[checkpoint[1]-1], checkpoint[0])
+				}
+			}
+			assert.Equal(t, serialRouter.checkpoints[len(serialRouter.checkpoints)-1], pipelinedRouter.checkpoints[len(pipelinedRouter.checkpoints)-1])
+			assert.Less(t, len(pipelinedRouter.checkpoints), len(serialRouter.checkpoints))
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	awsSQSTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
@@ -24,23 +26,94 @@ type QueueConsumer struct {
 	logger logs.Logger
 
 	queueClient Queue
-	svc         inboundprt.MovingAverageCalculator
+	svc         inboundprt.EventRouter
+
+	// bucket is how often the windows are advanced based on the wall-clock
+	bucket time.Duration
+	// gracePeriod is how long to wait after the end of a time-bucket before advancing the windows past it based on
+	// the wall-clock. If 0, windows only advance when events arrive.
+	gracePeriod time.Duration
+	// checkpointInterval is how often the state of the svc is checkpointed. Messages are only deleted from the queue
+	// once their events are part of a checkpoint, so that they're processed again if the state is lost. If 0, messages
+	// are deleted as soon as they're processed.
+	checkpointInterval time.Duration
+	// pollers is the number of goroutines polling the queue concurrently. If more than 1, the svc must be safe for
+	// concurrent use (e.g., an application.Concurrent).
+	pollers int
+
+	// exclusive is held for writing while the state is checkpointed or the windows are advanced, and for reading while
+	// messages are processed, so that the state of a checkpoint always includes the events of the messages it deletes,
+	// and only those, and the windows are never advanced in the middle of processing messages
+	exclusive sync.RWMutex
+
+	// mu guards the fields below, which are shared by the pollers
+	mu             sync.Mutex
+	lastCheckpoint time.Time
+	// processed holds the messages processed since the last checkpoint, which are deleted once it's stored
+	processed []awsSQSTypes.Message
+	// dirty is set when a batch of messages fails partway, since the state then has some of its events even though
+	// its messages are delivered again. The state is restored from the last checkpoint instead of checkpointed.
+	dirty bool
 }
 
-func NewQueueConsumer(logger logs.Logger, queueClient Queue, svc inboundprt.MovingAverageCalculator) QueueConsumer {
-	return QueueConsumer{
-		logger:      logger,
-		queueClient: queueClient,
-		svc:         svc,
+func NewQueueConsumer(logger logs.Logger, queueClient Queue, svc inboundprt.EventRouter, bucket, gracePeriod, checkpointInterval time.Duration, pollers int) *QueueConsumer {
+	return &QueueConsumer{
+		logger:             logger,
+		queueClient:        queueClient,
+		svc:                svc,
+		bucket:             bucket,
+		gracePeriod:        gracePeriod,
+		checkpointInterval: checkpointInterval,
+		pollers:            max(pollers, 1),
 	}
 }
 
-// PollAndProcess polls the queue and processes the messages
-func (c *QueueConsumer) PollAndProcess(ctx context.Context) {
-	// indefinitely poll queue for messages
-	for {
+// PollAndProcess polls the queue and processes the messages. If there is a grace period, the windows are also advanced
+// every time-bucket based on the wall-clock, so that time-buckets are written even when no messages arrive. The ticks
+// are handled by their own goroutine, so they're not delayed by a poll waiting for messages. If there is a checkpoint
+// interval, the state of the svc is checkpointed between polls once the interval has passed. Each poller polls and
+// processes the messages on its own, so with several pollers the events are processed in any order.
+//
+// It polls until the ctx is cancelled. The state is then checkpointed one last time, so that the messages processed
+// since the previous checkpoint are deleted from the queue, and the ctx error is returned.
+func (c *QueueConsumer) PollAndProcess(ctx context.Context) error {
+	// the state restored on startup is checkpointed first, so that there is always a checkpoint to restore when a batch
+	// of messages fails partway
+	if c.checkpointInterval > 0 {
+		c.checkpoint(ctx, 0)
+	}
+
+	var wg sync.WaitGroup
+	if c.gracePeriod > 0 {
+		wg.Go(func() {
+			c.tick(ctx)
+		})
+	}
+	for range c.pollers {
+		wg.Go(func() {
+			c.poll(ctx)
+		})
+	}
+	wg.Wait()
+
+	// the ctx is already cancelled, but the processed messages must still be deleted
+	if c.checkpointInterval > 0 {
+		c.checkpoint(context.WithoutCancel(ctx), 0)
+	}
+	return ctx.Err()
+}
+
+// poll polls the queue for messages until the ctx is cancelled
+func (c *QueueConsumer) poll(ctx context.Context) {
+	for ctx.Err() == nil {
+		if c.checkpointInterval > 0 {
+			c.checkpoint(ctx, c.checkpointInterval)
+		}
+
 		messages, err := c.readQueueMessages(ctx)
-		if errors.Is(err, errNoMessages) {
+		if ctx.Err() != nil {
+			break
+		} else if errors.Is(err, errNoMessages) {
 			c.logger.Info("no messages found")
 			continue
 		} else if err != nil {
@@ -52,6 +125,95 @@ func (c *QueueConsumer) PollAndProcess(ctx context.Context) {
 	}
 }
 
+// tick advances the windows every time-bucket based on the wall-clock, until the ctx is cancelled
+func (c *QueueConsumer) tick(ctx context.Context) {
+	ticker := time.NewTicker(c.bucket)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.advance(ctx, now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// advance advances the windows until the grace period before now. The messages being processed are processed first,
+// so the svc is never used by the poller and the ticker at the same time.
+func (c *QueueConsumer) advance(ctx context.Context, now time.Time) {
+	c.exclusive.Lock()
+	defer c.exclusive.Unlock()
+
+	err := c.svc.AdvanceTo(ctx, now.Add(-c.gracePeriod))
+	if err != nil {
+		c.logger.Errorw("could not advance windows based on the wall-clock", "error", err)
+	}
+}
+
+// checkpoint stores the state of the svc if the interval has passed since the last checkpoint, and then deletes the
+// messages processed since then. If the state can't be stored, the messages are kept until the next checkpoint.
+//
+// If the state is dirty, it's restored from the last checkpoint instead, and the messages processed since then are
+// not deleted, so all of them are delivered again.
+func (c *QueueConsumer) checkpoint(ctx context.Context, interval time.Duration) {
+	c.exclusive.Lock()
+	defer c.exclusive.Unlock()
+
+	c.mu.Lock()
+	due := time.Since(c.lastCheckpoint) >= interval
+	dirty := c.dirty
+	c.mu.Unlock()
+	if !due && !dirty {
+		return
+	}
+
+	if dirty {
+		c.restore(ctx)
+		return
+	}
+
+	// the offset isn't used, since the queue keeps track of the messages that were not deleted
+	err := c.svc.Checkpoint(ctx, 0)
+	if err != nil {
+		c.logger.Errorw("could not checkpoint state", "error", err)
+		return
+	}
+
+	// no message is processed while checkpointing, so the processed ones are exactly the ones part of the checkpoint
+	c.mu.Lock()
+	processed := c.processed
+	c.processed = nil
+	c.lastCheckpoint = time.Now()
+	c.mu.Unlock()
+
+	for _, message := range processed {
+		err = c.queueClient.Delete(ctx, message)
+		if err != nil {
+			c.logger.Errorw("could not delete from queue", "error", err)
+		}
+	}
+	c.logger.Infow("checkpointed state", "deleted_messages", len(processed))
+}
+
+// restore replaces the dirty state of the svc with the last checkpoint. The messages processed since then are
+// forgotten, so they're delivered again once their visibility timeout expires.
+func (c *QueueConsumer) restore(ctx context.Context) {
+	_, err := c.svc.Restore(ctx)
+	if err != nil {
+		c.logger.Errorw("could not restore state", "error", err)
+		return
+	}
+
+	c.mu.Lock()
+	forgotten := len(c.processed)
+	c.processed = nil
+	c.dirty = false
+	c.lastCheckpoint = time.Now()
+	c.mu.Unlock()
+	c.logger.Infow("restored state after a failed batch", "redelivered_messages", forgotten)
+}
+
 var errNoMessages = errors.New("no sqs messages found")
 
 func (c *QueueConsumer) readQueueMessages(ctx context.Context) ([]awsSQSTypes.Message, error) {
@@ -66,31 +228,73 @@ func (c *QueueConsumer) readQueueMessages(ctx context.Context) ([]awsSQSTypes.Me
 	return res.Messages, nil
 }
 
+// processMessages routes the events of the messages at once, so that their output is stored in bulk. If a message can't
+// be decoded, only the messages before it are processed, and the others are delivered again later.
 func (c *QueueConsumer) processMessages(ctx context.Context, messages []awsSQSTypes.Message) {
 	c.logger.Infow("read messages from queue", "quantity", len(messages))
+
+	events := make([]domain.Envelope, 0, len(messages))
+	decoded := make([]awsSQSTypes.Message, 0, len(messages))
 	for _, message := range messages {
-		if message.Body != nil {
-			var event domain.TranslationDelivered
-			err := json.Unmarshal([]byte(*message.Body), &event)
-			if err != nil {
-				// for simplicity purposes, when an error occurs we simply log it...
-				// ideally we'd have a better error handler, such as reporting the error to Sentry/NR
-				// and managing the message in the DLQ
-				c.logger.Errorw("error unmarshalling message", "error", err)
-				return
-			}
-
-			err = c.svc.ProcessEvent(event)
-			if err != nil {
-				c.logger.Errorw("could not process message", "error", err)
-				return
-			}
-
-			err = c.queueClient.Delete(ctx, message)
-			if err != nil {
-				c.logger.Errorw("could not delete from queue", "error", err)
-				return
-			}
+		if message.Body == nil {
+			continue
+		}
+		var event domain.Envelope
+		err := json.Unmarshal([]byte(*message.Body), &event)
+		if err != nil {
+			// for simplicity purposes, when an error occurs we simply log it...
+			// ideally we'd have a better error handler, such as reporting the error to Sentry/NR
+			// and managing the message in the DLQ
+			c.logger.Errorw("error unmarshalling message", "error", err)
+			break
 		}
+		events = append(events, event)
+		decoded = append(decoded, message)
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	err := c.route(ctx, events, decoded)
+	if err != nil {
+		c.logger.Errorw("could not process messages", "error", err)
+		return
+	}
+
+	if c.checkpointInterval > 0 {
+		// the messages are deleted once the state is checkpointed
+		return
+	}
+	for _, message := range decoded {
+		err = c.queueClient.Delete(ctx, message)
+		if err != nil {
+			c.logger.Errorw("could not delete from queue", "error", err)
+			return
+		}
+	}
+}
+
+// route processes the events of the messages, which are then kept to be deleted with the next checkpoint, if any. No
+// checkpoint is stored in between, otherwise it could include the events without deleting their messages. If the events
+// can't be processed, none of the messages are deleted, so they're delivered again, and the state is marked as dirty.
+//
+// The events are processed even if the ctx is cancelled meanwhile, so that a batch is never cut short by a shutdown.
+func (c *QueueConsumer) route(ctx context.Context, events []domain.Envelope, messages []awsSQSTypes.Message) error {
+	c.exclusive.RLock()
+	defer c.exclusive.RUnlock()
+
+	if err := c.svc.RouteEvents(context.WithoutCancel(ctx), events); err != nil {
+		if c.checkpointInterval > 0 {
+			c.mu.Lock()
+			c.dirty = true
+			c.mu.Unlock()
+		}
+		return err
+	}
+	if c.checkpointInterval > 0 {
+		c.mu.Lock()
+		c.processed = append(c.processed, messages...)
+		c.mu.Unlock()
 	}
+	return nil
 }
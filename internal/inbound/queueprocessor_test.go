@@ -0,0 +1,223 @@
+package inbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	awsSQSTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/lucaslobo/aggregator/internal/common/logs"
+	"github.com/lucaslobo/aggregator/internal/core/application"
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+	"github.com/lucaslobo/aggregator/internal/core/inboundprt"
+	"github.com/lucaslobo/aggregator/internal/core/outboundprt"
+)
+
+// idleQueue is a queue without messages, whose polls wait until the ctx is cancelled, like a long poll that never ends.
+// The other methods of the Queue are not used.
+type idleQueue struct {
+	Queue
+}
+
+func (idleQueue) GetMessages(ctx context.Context) (*sqs.ReceiveMessageOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// advanceRouter records the times the windows are advanced to. The other methods of the EventRouter are not used.
+type advanceRouter struct {
+	inboundprt.EventRouter
+
+	mu       sync.Mutex
+	advanced []time.Time
+}
+
+func (r *advanceRouter) AdvanceTo(_ context.Context, t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advanced = append(r.advanced, t)
+	return nil
+}
+
+func (r *advanceRouter) advances() []time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Time(nil), r.advanced...)
+}
+
+func TestPollAndProcess_Idle(t *testing.T) {
+	logger := logs.Logger{SugaredLogger: zap.NewNop().Sugar()}
+	router := &advanceRouter{}
+	const bucket, gracePeriod = 10 * time.Millisecond, time.Hour
+	consumer := NewQueueConsumer(logger, idleQueue{}, router, bucket, gracePeriod, 0, 1)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		assert.ErrorIs(t, consumer.PollAndProcess(ctx), context.Canceled)
+	})
+
+	// the poll never returns while the queue is idle, but the windows are advanced every time-bucket anyway
+	start := time.Now()
+	require.Eventually(t, func() bool {
+		return len(router.advances()) >= 3
+	}, 5*time.Second, bucket)
+	cancel()
+	wg.Wait()
+
+	for _, advanced := range router.advances() {
+		// the windows are advanced until the grace period before the tick
+		assert.WithinRange(t, advanced, start.Add(-gracePeriod), time.Now().Add(-gracePeriod))
+	}
+}
+
+// callLog records, in order, the calls made to the fakes that share it
+type callLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *callLog) add(call string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, call)
+}
+
+func (l *callLog) list() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.calls...)
+}
+
+// batchQueue delivers its messages in a single poll, and then is idle. It records the messages deleted. The other
+// methods of the Queue are not used.
+type batchQueue struct {
+	idleQueue
+	log      *callLog
+	mu       sync.Mutex
+	messages []awsSQSTypes.Message
+}
+
+func (q *batchQueue) GetMessages(ctx context.Context) (*sqs.ReceiveMessageOutput, error) {
+	q.mu.Lock()
+	messages := q.messages
+	q.messages = nil
+	q.mu.Unlock()
+	if messages == nil {
+		return q.idleQueue.GetMessages(ctx)
+	}
+	return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+func (q *batchQueue) Delete(_ context.Context, message awsSQSTypes.Message) error {
+	q.log.add("delete " + *message.MessageId)
+	return nil
+}
+
+// logStateStorer keeps the last state stored, and records the states stored and loaded. It fails to store them if err
+// is set.
+type logStateStorer struct {
+	log   *callLog
+	err   error
+	state []byte
+}
+
+func (s *logStateStorer) StoreState(_ context.Context, state []byte) error {
+	if s.err != nil {
+		s.log.add("store failed")
+		return s.err
+	}
+	s.log.add("store")
+	s.state = state
+	return nil
+}
+
+func (s *logStateStorer) LoadState(_ context.Context) ([]byte, error) {
+	s.log.add("load")
+	return s.state, nil
+}
+
+// failingStorer fails to store any output
+type failingStorer struct {
+	memoryStorer
+}
+
+func (failingStorer) StoreMovingAverage(_ context.Context, _ domain.AverageDeliveryTime) error {
+	return errors.New("disk full")
+}
+
+func (failingStorer) StoreMovingAverageSlice(_ context.Context, _ []domain.AverageDeliveryTime) error {
+	return errors.New("disk full")
+}
+
+func TestPollAndProcess_Checkpoint(t *testing.T) {
+	tests := []struct {
+		name      string
+		storeErr  error
+		outputErr bool
+		// done is true once the consumer went far enough to be stopped
+		done     func(calls []string) bool
+		expected []string
+	}{
+		{
+			name: "messages deleted once the checkpoint is stored",
+			done: func(calls []string) bool { return len(calls) >= 6 },
+			// the state is checkpointed on startup, before each poll and on shutdown
+			expected: []string{"store", "store", "store", "delete m1", "delete m2", "delete m3", "store"},
+		},
+		{
+			name:     "messages kept when the checkpoint can't be stored",
+			storeErr: errors.New("disk full"),
+			done:     func(calls []string) bool { return len(calls) >= 3 },
+			expected: []string{"store failed", "store failed", "store failed", "store failed"},
+		},
+		{
+			name:      "state restored instead of checkpointed after a failed batch",
+			outputErr: true,
+			done:      func(calls []string) bool { return len(calls) >= 3 },
+			// the messages are delivered again, so the state with part of their events is never stored
+			expected: []string{"store", "store", "load", "store"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			log := &callLog{}
+			queue := &batchQueue{log: log}
+			for i, minute := range []int{11, 15, 23} {
+				id := fmt.Sprintf("m%d", i+1)
+				body := fmt.Sprintf(`{"timestamp": "2018-12-26 18:%d:00.000000", "translation_id": "%s", "event_name": "translation_delivered", "duration": 20}`, minute, id)
+				queue.messages = append(queue.messages, awsSQSTypes.Message{MessageId: &id, Body: &body})
+			}
+
+			cfg := application.Config{WindowSize: 5, StateStorer: &logStateStorer{log: log, err: tc.storeErr}}
+			var storer outboundprt.MovingAverageStorer = &memoryStorer{}
+			if tc.outputErr {
+				storer = &failingStorer{}
+			}
+			router := application.NewRouter(cfg, application.New(cfg, storer))
+			consumer := NewQueueConsumer(logs.Logger{SugaredLogger: zap.NewNop().Sugar()}, queue, router, time.Minute, 0, time.Nanosecond, 1)
+
+			ctx, cancel := context.WithCancel(t.Context())
+			var wg sync.WaitGroup
+			wg.Go(func() {
+				assert.ErrorIs(t, consumer.PollAndProcess(ctx), context.Canceled)
+			})
+			require.Eventually(t, func() bool {
+				return tc.done(log.list())
+			}, 5*time.Second, time.Millisecond)
+			cancel()
+			wg.Wait()
+
+			assert.Equal(t, tc.expected, log.list())
+		})
+	}
+}
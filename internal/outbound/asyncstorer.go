@@ -0,0 +1,171 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+	"github.com/lucaslobo/aggregator/internal/core/outboundprt"
+)
+
+// OutputStorer is implemented by the adapters that store all the kinds of output (e.g., FileWriter and StdOut)
+type OutputStorer interface {
+	outboundprt.MovingAverageStorer
+	outboundprt.PercentileStorer
+	outboundprt.RejectedEventStorer
+}
+
+// AsyncStorer stores the output with an OutputStorer in a separate goroutine, so that the aggregation doesn't wait for
+// the writes. The writes are done in the order they're received, and at most size of them are buffered: once the buffer
+// is full, storing waits for the writes to catch up (backpressure).
+//
+// Once buffered, a write is done even if its ctx is cancelled. If a write fails, the following ones are dropped, and its
+// error is returned by the next call.
+//
+// It's also a StateStorer: the state is stored by the same goroutine, once the output received before it is written, so
+// that a checkpoint never refers to output that isn't written yet (e.g., the position of a FileWriter).
+type AsyncStorer struct {
+	output OutputStorer
+	state  outboundprt.StateStorer
+
+	writes chan func()
+	done   chan struct{}
+
+	mu sync.Mutex
+	// err is the error of the first failed write
+	err error
+}
+
+// NewAsyncStorer creates an AsyncStorer, and starts the goroutine that writes to the output. The state is optional.
+func NewAsyncStorer(output OutputStorer, state outboundprt.StateStorer, size int) *AsyncStorer {
+	a := &AsyncStorer{
+		output: output,
+		state:  state,
+		writes: make(chan func(), size),
+		done:   make(chan struct{}),
+	}
+	go a.write()
+	return a
+}
+
+func (a *AsyncStorer) write() {
+	defer close(a.done)
+	for write := range a.writes {
+		write()
+	}
+}
+
+func (a *AsyncStorer) failed() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// enqueue buffers the write, unless a previous one failed. It only waits for room in the buffer while the ctx isn't
+// cancelled.
+func (a *AsyncStorer) enqueue(ctx context.Context, store func(ctx context.Context) error) error {
+	if err := a.failed(); err != nil {
+		return err
+	}
+
+	write := func() {
+		if a.failed() != nil {
+			return
+		}
+		if err := store(context.WithoutCancel(ctx)); err != nil {
+			a.mu.Lock()
+			a.err = err
+			a.mu.Unlock()
+		}
+	}
+	select {
+	case a.writes <- write:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait runs the call in the writing goroutine, once the writes buffered before it are done, and returns its result.
+// The call isn't run if a write failed.
+func (a *AsyncStorer) wait(ctx context.Context, call func() error) error {
+	result := make(chan error, 1)
+	write := func() {
+		if err := a.failed(); err != nil {
+			result <- err
+			return
+		}
+		result <- call()
+	}
+	select {
+	case a.writes <- write:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-result
+}
+
+func (a *AsyncStorer) StoreMovingAverage(ctx context.Context, dt domain.AverageDeliveryTime) error {
+	return a.enqueue(ctx, func(ctx context.Context) error {
+		return a.output.StoreMovingAverage(ctx, dt)
+	})
+}
+
+// StoreMovingAverageSlice buffers the slice as a single write, so the slice must not be modified afterward
+func (a *AsyncStorer) StoreMovingAverageSlice(ctx context.Context, deliveryTimes []domain.AverageDeliveryTime) error {
+	return a.enqueue(ctx, func(ctx context.Context) error {
+		return a.output.StoreMovingAverageSlice(ctx, deliveryTimes)
+	})
+}
+
+func (a *AsyncStorer) StorePercentiles(ctx context.Context, pdt domain.PercentileDeliveryTime) error {
+	return a.enqueue(ctx, func(ctx context.Context) error {
+		return a.output.StorePercentiles(ctx, pdt)
+	})
+}
+
+// StorePercentilesSlice buffers the slice as a single write, so the slice must not be modified afterward
+func (a *AsyncStorer) StorePercentilesSlice(ctx context.Context, percentiles []domain.PercentileDeliveryTime) error {
+	return a.enqueue(ctx, func(ctx context.Context) error {
+		return a.output.StorePercentilesSlice(ctx, percentiles)
+	})
+}
+
+func (a *AsyncStorer) StoreRejectedEvent(ctx context.Context, rejected domain.RejectedEvent) error {
+	return a.enqueue(ctx, func(ctx context.Context) error {
+		return a.output.StoreRejectedEvent(ctx, rejected)
+	})
+}
+
+// StoreState waits for the output buffered before it to be written, and then stores the state
+func (a *AsyncStorer) StoreState(ctx context.Context, state []byte) error {
+	return a.wait(ctx, func() error {
+		return a.state.StoreState(ctx, state)
+	})
+}
+
+// LoadState loads the state in the writing goroutine, since it may roll back the output (e.g., with a StateFile)
+func (a *AsyncStorer) LoadState(ctx context.Context) ([]byte, error) {
+	var state []byte
+	err := a.wait(ctx, func() error {
+		var err error
+		state, err = a.state.LoadState(ctx)
+		return err
+	})
+	return state, err
+}
+
+// Flush waits for the buffered output to be written, and returns the error of the first failed write, if any
+func (a *AsyncStorer) Flush(ctx context.Context) error {
+	return a.wait(ctx, func() error {
+		return nil
+	})
+}
+
+// Close writes the buffered output, and then closes the OutputStorer. The AsyncStorer must not be used afterward.
+func (a *AsyncStorer) Close() error {
+	close(a.writes)
+	<-a.done
+	return errors.Join(a.failed(), a.output.Close())
+}
@@ -1,8 +1,11 @@
 package outbound
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"time"
 
@@ -10,31 +13,51 @@ import (
 	"github.com/lucaslobo/aggregator/internal/core/domain"
 )
 
-// FileWriter is an implementation of a MovingAverageStorer that writes to a file.
+// FileWriter is an implementation of a MovingAverageStorer and a PercentileStorer that writes to a file.
+// It also implements a RejectedEventStorer, which writes to a separate file in the same folder.
 type FileWriter struct {
 	logger logs.Logger
 	folder string
+	// name is used as prefix of the output file name
+	name string
 
-	file           *os.File
-	encoder        *json.Encoder
+	rejected *FileWriter
+
+	file    *os.File
+	encoder *json.Encoder
+	// outputFilePath is chosen up front, even though the file is only created once something is written to it, so that
+	// its position can be stored before that
 	outputFilePath string
 }
 
 func NewFileWriter(logger logs.Logger, folder string) *FileWriter {
 	return &FileWriter{
-		logger: logger,
-		folder: folder,
+		logger:         logger,
+		folder:         folder,
+		name:           "events",
+		outputFilePath: getOutputPath(folder, "events"),
+		rejected: &FileWriter{
+			logger:         logger,
+			folder:         folder,
+			name:           "rejected",
+			outputFilePath: getOutputPath(folder, "rejected"),
+		},
 	}
 }
 
 func (f *FileWriter) Close() error {
+	var err error
+	if f.rejected != nil {
+		err = f.rejected.Close()
+	}
+
 	file := f.file
 	f.file = nil
 	f.encoder = nil
 	if file != nil {
-		return file.Close()
+		return errors.Join(file.Close(), err)
 	}
-	return nil
+	return err
 }
 
 func (f *FileWriter) setupJSONEncoder() error {
@@ -42,13 +65,10 @@ func (f *FileWriter) setupJSONEncoder() error {
 		return nil
 	}
 
-	outputDir, err := createDir(f.folder)
-	if err != nil {
+	if _, err := createDir(f.folder); err != nil {
 		return err
 	}
 
-	f.outputFilePath = getOutputPath(outputDir, "events")
-
 	file, err := os.Create(f.outputFilePath)
 	if err != nil {
 		return err
@@ -59,7 +79,10 @@ func (f *FileWriter) setupJSONEncoder() error {
 	return nil
 }
 
-func (f *FileWriter) StoreMovingAverage(dt domain.AverageDeliveryTime) error {
+func (f *FileWriter) StoreMovingAverage(ctx context.Context, dt domain.AverageDeliveryTime) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	err := f.setupJSONEncoder()
 	if err != nil {
 		return err
@@ -70,7 +93,10 @@ func (f *FileWriter) StoreMovingAverage(dt domain.AverageDeliveryTime) error {
 	return nil
 }
 
-func (f *FileWriter) StoreMovingAverageSlice(deliveryTimes []domain.AverageDeliveryTime) error {
+func (f *FileWriter) StoreMovingAverageSlice(ctx context.Context, deliveryTimes []domain.AverageDeliveryTime) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	err := f.setupJSONEncoder()
 	if err != nil {
 		return err
@@ -85,6 +111,109 @@ func (f *FileWriter) StoreMovingAverageSlice(deliveryTimes []domain.AverageDeliv
 	return nil
 }
 
+func (f *FileWriter) StorePercentiles(ctx context.Context, pdt domain.PercentileDeliveryTime) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := f.setupJSONEncoder()
+	if err != nil {
+		return err
+	}
+	if err = f.encoder.Encode(pdt); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (f *FileWriter) StorePercentilesSlice(ctx context.Context, percentiles []domain.PercentileDeliveryTime) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := f.setupJSONEncoder()
+	if err != nil {
+		return err
+	}
+
+	for _, pdt := range percentiles {
+		if err = f.encoder.Encode(pdt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *FileWriter) StoreRejectedEvent(ctx context.Context, rejected domain.RejectedEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := f.rejected.setupJSONEncoder()
+	if err != nil {
+		return err
+	}
+	if err = f.rejected.encoder.Encode(rejected); err != nil {
+		return err
+	}
+	return nil
+}
+
+// outputPosition is the size of an output file at a given point, which allows to roll back what's written after it
+type outputPosition struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// position returns the current position of the output file, which is its beginning if nothing was written yet. The file
+// is synced, so that it's never shorter than the position after a crash.
+func (f *FileWriter) position() (*outputPosition, error) {
+	if f.file == nil {
+		return &outputPosition{Path: f.outputFilePath}, nil
+	}
+	if err := f.file.Sync(); err != nil {
+		return nil, err
+	}
+	size, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return &outputPosition{Path: f.outputFilePath, Size: size}, nil
+}
+
+// rollback opens the output file of the position, discarding everything written after it, so that the output is
+// appended to it. If the position is the beginning of the file, it's only created once something is written to it.
+func (f *FileWriter) rollback(position *outputPosition) error {
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			return err
+		}
+		f.file, f.encoder = nil, nil
+	}
+	f.outputFilePath = position.Path
+
+	if position.Size == 0 {
+		err := os.Truncate(position.Path, 0)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	file, err := os.OpenFile(position.Path, os.O_WRONLY|os.O_CREATE, 0o666)
+	if err != nil {
+		return err
+	}
+	if err = file.Truncate(position.Size); err == nil {
+		_, err = file.Seek(position.Size, io.SeekStart)
+	}
+	if err != nil {
+		return errors.Join(err, file.Close())
+	}
+
+	f.file = file
+	f.encoder = json.NewEncoder(file)
+	return nil
+}
+
 func createDir(dir string) (string, error) {
 	// Create the output directory if it doesn't exist
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
@@ -0,0 +1,108 @@
+package outbound
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// StateFile is an implementation of a StateStorer that keeps the state in a local file. If there is an output
+// FileWriter, the position of its files is stored along with the state, and they're rolled back to it when the state
+// is loaded. This way, the output written after the last stored state isn't duplicated after a restart.
+type StateFile struct {
+	path   string
+	output *FileWriter
+}
+
+// NewStateFile creates a StateFile. The output is optional.
+func NewStateFile(path string, output *FileWriter) *StateFile {
+	return &StateFile{
+		path:   path,
+		output: output,
+	}
+}
+
+// stateFileContent is the content of the state file
+type stateFileContent struct {
+	State    json.RawMessage `json:"state"`
+	Output   *outputPosition `json:"output,omitempty"`
+	Rejected *outputPosition `json:"rejected,omitempty"`
+}
+
+// StoreState replaces the file atomically: the state is written to a temporary file, which is then renamed. This way,
+// a crash while writing never leaves a partial state behind.
+func (s *StateFile) StoreState(ctx context.Context, state []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	content := stateFileContent{State: state}
+	if s.output != nil {
+		var err error
+		if content.Output, err = s.output.position(); err != nil {
+			return err
+		}
+		if content.Rejected, err = s.output.rejected.position(); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	if _, err = createDir(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		// the state must be on disk before it replaces the previous one
+		err = file.Sync()
+	}
+	if err = errors.Join(err, file.Close()); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// LoadState returns the stored state, and rolls back the output files to their position when it was stored
+func (s *StateFile) LoadState(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var content stateFileContent
+	if err = json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+
+	if s.output != nil && content.Output != nil {
+		if err = s.output.rollback(content.Output); err != nil {
+			return nil, err
+		}
+	}
+	if s.output != nil && content.Rejected != nil {
+		if err = s.output.rejected.rollback(content.Rejected); err != nil {
+			return nil, err
+		}
+	}
+	return content.State, nil
+}
@@ -0,0 +1,94 @@
+package outbound
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/lucaslobo/aggregator/internal/common/logs"
+	"github.com/lucaslobo/aggregator/internal/core/domain"
+)
+
+func TestStateFile_Resume(t *testing.T) {
+	logger := logs.Logger{SugaredLogger: zap.NewNop().Sugar()}
+	tests := []struct {
+		name string
+		// before is stored before the state, and after is stored after it, until the crash
+		before, after []int
+	}{
+		{name: "output before the state", before: []int{10, 11}, after: []int{12, 13}},
+		// the state pins the file the output is going to be written to, even though it doesn't exist yet
+		{name: "no output before the state", after: []int{10, 11}},
+		{name: "no output"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			folder, statePath := t.TempDir(), filepath.Join(t.TempDir(), "state.json")
+
+			writer := NewFileWriter(logger, folder)
+			state := NewStateFile(statePath, writer)
+			storeAverages(t, writer, tc.before)
+			require.NoError(t, state.StoreState(t.Context(), []byte(`{"offset":1}`)))
+			// the process crashes after this, without closing the writer
+			storeAverages(t, writer, tc.after)
+
+			// the resumed run is started a little later, so that its files would have other names
+			time.Sleep(time.Second)
+			resumed := NewFileWriter(logger, folder)
+			loaded, err := NewStateFile(statePath, resumed).LoadState(t.Context())
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"offset":1}`, string(loaded))
+			// the output written after the state is stored again once it's reprocessed
+			storeAverages(t, resumed, tc.after)
+			require.NoError(t, resumed.Close())
+			require.NoError(t, writer.Close())
+
+			files, err := filepath.Glob(filepath.Join(folder, "*.json"))
+			require.NoError(t, err)
+			expected := append(append([]int{}, tc.before...), tc.after...)
+			if len(expected) == 0 {
+				assert.Empty(t, files)
+				return
+			}
+			// there are no rejected events, so there's a single output file
+			require.Len(t, files, 1)
+			assert.Equal(t, writer.outputFilePath, files[0])
+			assert.Equal(t, expectedOutput(t, expected), readFile(t, files[0]))
+		})
+	}
+}
+
+func TestStateFile_LoadWithoutState(t *testing.T) {
+	writer := NewFileWriter(logs.Logger{SugaredLogger: zap.NewNop().Sugar()}, t.TempDir())
+	loaded, err := NewStateFile(filepath.Join(t.TempDir(), "state.json"), writer).LoadState(t.Context())
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+}
+
+// storeAverages stores an average for each of the provided minutes, which identify them
+func storeAverages(t *testing.T, writer *FileWriter, minutes []int) {
+	for _, minute := range minutes {
+		date := domain.Time{Time: time.Date(2018, 12, 26, 18, minute, 0, 0, time.UTC)}
+		require.NoError(t, writer.StoreMovingAverage(t.Context(), domain.AverageDeliveryTime{Date: date}))
+	}
+}
+
+// expectedOutput returns the output of the averages of the provided minutes, written in a single run
+func expectedOutput(t *testing.T, minutes []int) string {
+	writer := NewFileWriter(logs.Logger{SugaredLogger: zap.NewNop().Sugar()}, t.TempDir())
+	storeAverages(t, writer, minutes)
+	require.NoError(t, writer.Close())
+	return readFile(t, writer.outputFilePath)
+}
+
+func readFile(t *testing.T, path string) string {
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(content)
+}
@@ -1,13 +1,16 @@
 package outbound
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 
 	"github.com/lucaslobo/aggregator/internal/core/domain"
 )
 
-// StdOut is a simple implementation of a MovingAverageStorer that simply writes to the std output.
+// StdOut is a simple implementation of a MovingAverageStorer and a PercentileStorer that simply writes to the std output.
+// It also implements a RejectedEventStorer, which writes to the std error.
 type StdOut struct {
 }
 
@@ -15,18 +18,27 @@ func NewStdOut() StdOut {
 	return StdOut{}
 }
 
-func (s StdOut) StoreMovingAverage(item domain.AverageDeliveryTime) error {
-	bytes, err := json.Marshal(item)
-	if err != nil {
-		return fmt.Errorf("error marshalling JSON: %w", err)
+func (s StdOut) StoreMovingAverage(ctx context.Context, item domain.AverageDeliveryTime) error {
+	return s.print(ctx, item)
+}
+
+func (s StdOut) StoreMovingAverageSlice(ctx context.Context, items []domain.AverageDeliveryTime) error {
+	for _, item := range items {
+		err := s.StoreMovingAverage(ctx, item)
+		if err != nil {
+			return err
+		}
 	}
-	fmt.Println(string(bytes))
 	return nil
 }
 
-func (s StdOut) StoreMovingAverageSlice(items []domain.AverageDeliveryTime) error {
+func (s StdOut) StorePercentiles(ctx context.Context, item domain.PercentileDeliveryTime) error {
+	return s.print(ctx, item)
+}
+
+func (s StdOut) StorePercentilesSlice(ctx context.Context, items []domain.PercentileDeliveryTime) error {
 	for _, item := range items {
-		err := s.StoreMovingAverage(item)
+		err := s.StorePercentiles(ctx, item)
 		if err != nil {
 			return err
 		}
@@ -34,6 +46,28 @@ func (s StdOut) StoreMovingAverageSlice(items []domain.AverageDeliveryTime) erro
 	return nil
 }
 
+// StoreRejectedEvent writes the rejected event to the std error, so that it's not mixed with the aggregated output
+func (s StdOut) StoreRejectedEvent(ctx context.Context, item domain.RejectedEvent) error {
+	bytes, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("error marshalling JSON: %w", err)
+	}
+	_, err = fmt.Fprintln(os.Stderr, string(bytes))
+	return err
+}
+
+func (s StdOut) print(ctx context.Context, item any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("error marshalling JSON: %w", err)
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
 func (s StdOut) Close() error {
 	// there's no point in closing anything here, let's just return silently
 	return nil
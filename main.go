@@ -30,6 +30,8 @@ func main() {
 		Before:      setupBefore,
 		Commands: []*cli.Command{
 			cmd.MovingAverageCommand,
+			cmd.MovingPercentileCommand,
+			cmd.ExponentialMovingAverageCommand,
 		},
 		DefaultCommand: cmd.MovingAverageCommand.Name,
 	}